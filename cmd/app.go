@@ -8,6 +8,8 @@ func App() *cli.App {
 	app := cli.NewApp()
 	app.Name = "rdb-seeder-stresser"
 	app.Usage = "Utility seeding and stress testing DB"
+	// the --session-init statements have commas, --tables splits its values itself
+	app.DisableSliceFlagSeparator = true
 
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
@@ -21,6 +23,9 @@ func App() *cli.App {
 	app.Commands = []*cli.Command{
 		Seed,
 		Stress,
+		Init,
+		Profile,
+		GenerateSQLs,
 	}
 
 	return app
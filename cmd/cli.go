@@ -4,6 +4,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/seed"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stress"
+	"time"
 )
 
 var Seed = &cli.Command{
@@ -19,16 +20,14 @@ var Seed = &cli.Command{
 			Usage:   "Job Configuration JSON file.",
 		},
 		&cli.StringFlag{
-			Name:     "db-url",
-			EnvVars:  []string{"DB_URL"},
-			Usage:    "The connection string used to connect to the database.",
-			Required: true,
+			Name:    "db-url",
+			EnvVars: []string{"DB_URL"},
+			Usage:   "The connection string used to connect to the database. Not needed with --output.",
 		},
 		&cli.StringFlag{
-			Name:     "db-type",
-			EnvVars:  []string{"DB_TYPE"},
-			Usage:    "The DB type: MySQL or PostgreSQL.",
-			Required: true,
+			Name:    "db-type",
+			EnvVars: []string{"DB_TYPE"},
+			Usage:   "The DB type: postgres, mysql or sqlite. The dialect of the sql and copy outputs.",
 		},
 		&cli.StringFlag{
 			Name:     "out-dir",
@@ -37,6 +36,66 @@ var Seed = &cli.Command{
 			Usage:    "Path where the files with detailed stats will be placed",
 			Required: true,
 		},
+		&cli.StringFlag{
+			Name:    "output",
+			EnvVars: []string{"OUTPUT"},
+			Usage:   "Write the rows to a file per table in out-dir instead of the database: csv, jsonl, sql (INSERT statements) or copy (postgres COPY).",
+		},
+		&cli.BoolFlag{
+			Name:    "gzip",
+			EnvVars: []string{"GZIP"},
+			Usage:   "Compress the --output files with gzip.",
+		},
+		&cli.BoolFlag{
+			Name:    "create-schema",
+			EnvVars: []string{"CREATE_SCHEMA"},
+			Usage:   "Create the tables that don't exist from their schema config and build their indexes after seeding.",
+		},
+		&cli.BoolFlag{
+			Name:    "drop-existing",
+			EnvVars: []string{"DROP_EXISTING"},
+			Usage:   "Drop the tables and create them anew from their schema config.",
+		},
+		&cli.BoolFlag{
+			Name:    "truncate",
+			EnvVars: []string{"TRUNCATE"},
+			Usage:   "Remove the existing rows from the tables before seeding.",
+		},
+		&cli.Int64Flag{
+			Name:    "random-seed",
+			EnvVars: []string{"RANDOM_SEED"},
+			Usage:   "Seed of the generated values, the same seed and config produce the same data. Random if 0.",
+		},
+		&cli.BoolFlag{
+			Name:    "resume",
+			EnvVars: []string{"RESUME"},
+			Usage:   "Continue the seed run recorded in the checkpoint file of out-dir, skipping the rows it has committed.",
+		},
+		&cli.IntFlag{
+			Name:    "max-conns",
+			EnvVars: []string{"MAX_CONNS"},
+			Usage:   "Connections in the pool the threads share. 0 for as many as the most threads the run has.",
+		},
+		&cli.IntFlag{
+			Name:    "min-conns",
+			EnvVars: []string{"MIN_CONNS"},
+			Usage:   "Connections the pool opens up front and keeps open.",
+		},
+		&cli.DurationFlag{
+			Name:    "conn-idle-timeout",
+			EnvVars: []string{"CONN_IDLE_TIMEOUT"},
+			Usage:   "Close the connections idle for longer, e.g. 30s. 0 keeps them.",
+		},
+		&cli.DurationFlag{
+			Name:    "conn-max-lifetime",
+			EnvVars: []string{"CONN_MAX_LIFETIME"},
+			Usage:   "Replace the connections open for longer, e.g. 5m. 0 keeps them.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "session-init",
+			EnvVars: []string{"SESSION_INIT"},
+			Usage:   "Statement each new connection runs, like SET work_mem = '64MB'. Repeat the flag for more, they run before the config ones.",
+		},
 	},
 }
 
@@ -52,6 +111,16 @@ var Stress = &cli.Command{
 			EnvVars: []string{"SQLS_FILE"},
 			Usage:   "File with the SQLs for stress testing",
 		},
+		&cli.PathFlag{
+			Name:    "config",
+			EnvVars: []string{"STRESS_CONFIG_JSON"},
+			Usage:   "Render the SQLs of the stressConfig of this seed config on the fly instead of reading --sqls-file. Needs --pools-file.",
+		},
+		&cli.PathFlag{
+			Name:    "pools-file",
+			EnvVars: []string{"POOLS_FILE"},
+			Usage:   "The value pools the seed saved to the pools_to_file of the config, for --config.",
+		},
 		&cli.StringFlag{
 			Name:     "db-url",
 			EnvVars:  []string{"DB_URL"},
@@ -61,7 +130,7 @@ var Stress = &cli.Command{
 		&cli.StringFlag{
 			Name:     "db-type",
 			EnvVars:  []string{"DB_TYPE"},
-			Usage:    "The DB type: MySQL or PostgreSQL.",
+			Usage:    "The DB type: postgres, mysql or sqlite.",
 			Required: true,
 		},
 		&cli.StringFlag{
@@ -71,5 +140,232 @@ var Stress = &cli.Command{
 			Usage:    "Path where the files with detailed stats will be placed",
 			Required: true,
 		},
+		&cli.IntFlag{
+			Name:    "max-conns",
+			EnvVars: []string{"MAX_CONNS"},
+			Usage:   "Connections in the pool the threads share. 0 for as many as the most threads the run has.",
+		},
+		&cli.IntFlag{
+			Name:    "min-conns",
+			EnvVars: []string{"MIN_CONNS"},
+			Usage:   "Connections the pool opens up front and keeps open.",
+		},
+		&cli.DurationFlag{
+			Name:    "conn-idle-timeout",
+			EnvVars: []string{"CONN_IDLE_TIMEOUT"},
+			Usage:   "Close the connections idle for longer, e.g. 30s. 0 keeps them.",
+		},
+		&cli.DurationFlag{
+			Name:    "conn-max-lifetime",
+			EnvVars: []string{"CONN_MAX_LIFETIME"},
+			Usage:   "Replace the connections open for longer, e.g. 5m. 0 keeps them.",
+		},
+		&cli.IntFlag{
+			Name:    "reconnect-every",
+			EnvVars: []string{"RECONNECT_EVERY"},
+			Usage:   "Open a new connection every N statements per thread, bypassing the pool, and report the connect time. 0 to use the pool.",
+		},
+		&cli.BoolFlag{
+			Name:    "tls",
+			EnvVars: []string{"TLS"},
+			Usage:   "Connect over TLS without verifying the server certificate. The handshake is in the --reconnect-every connect time.",
+		},
+		&cli.IntFlag{
+			Name:    "tx-retries",
+			EnvVars: []string{"TX_RETRIES"},
+			Value:   3,
+			Usage:   "Run a transaction aborted by a serialization failure or a deadlock again up to N times. The retries of a group override it.",
+		},
+		&cli.IntFlag{
+			Name:    "stmt-cache",
+			EnvVars: []string{"STMT_CACHE"},
+			Usage:   "Prepared statements kept per connection for the SQLs with an ARGS line. 0 prepares each of them anew.",
+		},
+		&cli.DurationFlag{
+			Name:    "statement-timeout",
+			EnvVars: []string{"STATEMENT_TIMEOUT"},
+			Usage:   "Cancel the statements running longer, e.g. 5s, and count them as timeouts. A TIMEOUT line of an ID overrides it. 0 for no limit.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "session-init",
+			EnvVars: []string{"SESSION_INIT"},
+			Usage:   "Statement each new connection runs, like SET work_mem = '64MB'. Repeat the flag for more, they run before the config ones.",
+		},
+		&cli.StringFlag{
+			Name:    "find-capacity",
+			EnvVars: []string{"FIND_CAPACITY"},
+			Usage:   "Instead of running the sqls, search the most throughput of the SQLs of this ID under --capacity-slo, on more and more threads.",
+		},
+		&cli.DurationFlag{
+			Name:    "capacity-slo",
+			EnvVars: []string{"CAPACITY_SLO"},
+			Usage:   "The latency the --capacity-percentile of the SQLs of a --find-capacity step must stay under, e.g. 100ms.",
+		},
+		&cli.Float64Flag{
+			Name:    "capacity-percentile",
+			EnvVars: []string{"CAPACITY_PERCENTILE"},
+			Value:   99,
+			Usage:   "The percentile of the SQL durations held to --capacity-slo.",
+		},
+		&cli.Float64Flag{
+			Name:    "capacity-max-errors",
+			EnvVars: []string{"CAPACITY_MAX_ERRORS"},
+			Value:   0.01,
+			Usage:   "The share (0..1) of the SQLs of a --find-capacity step that may fail or time out.",
+		},
+		&cli.DurationFlag{
+			Name:    "capacity-step",
+			EnvVars: []string{"CAPACITY_STEP"},
+			Value:   30 * time.Second,
+			Usage:   "How long each --find-capacity step runs.",
+		},
+		&cli.IntFlag{
+			Name:    "capacity-max-threads",
+			EnvVars: []string{"CAPACITY_MAX_THREADS"},
+			Value:   256,
+			Usage:   "The most threads --find-capacity tries.",
+		},
+	},
+}
+
+var Init = &cli.Command{
+	Name:        "init",
+	Description: "Write a seed config for existing tables reading their definitions from the database.",
+	Usage:       "seeder-tester init --tables table_1,table_2",
+	Action:      seed.Init, //function
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:    "config",
+			Value:   "./config.json",
+			EnvVars: []string{"CONFIG_JSON"},
+			Usage:   "Job Configuration JSON file to write.",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Replace the config file if it exists.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "tables",
+			EnvVars:  []string{"TABLES"},
+			Usage:    "Tables to generate the seed config for.",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "records",
+			Value: 1000,
+			Usage: "Records to seed per table.",
+		},
+		&cli.IntFlag{
+			Name:  "threads",
+			Value: 4,
+			Usage: "Insert threads per table.",
+		},
+		&cli.StringFlag{
+			Name:     "db-url",
+			EnvVars:  []string{"DB_URL"},
+			Usage:    "The connection string used to connect to the database.",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "db-type",
+			EnvVars:  []string{"DB_TYPE"},
+			Usage:    "The DB type: postgres, mysql or sqlite.",
+			Required: true,
+		},
+	},
+}
+
+var Profile = &cli.Command{
+	Name:        "profile",
+	Description: "Write a seed config for existing tables with the value distributions sampled from their data.",
+	Usage:       "seeder-tester profile --tables table_1,table_2",
+	Action:      seed.Profile, //function
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:    "config",
+			Value:   "./config.json",
+			EnvVars: []string{"CONFIG_JSON"},
+			Usage:   "Job Configuration JSON file to write.",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Replace the config file if it exists.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "tables",
+			EnvVars:  []string{"TABLES"},
+			Usage:    "Tables to profile.",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "records",
+			Usage: "Records to seed per table. 0 to seed as many as the profiled table has.",
+		},
+		&cli.IntFlag{
+			Name:  "threads",
+			Value: 4,
+			Usage: "Insert threads per table.",
+		},
+		&cli.IntFlag{
+			Name:  "sample",
+			Usage: "Rows to sample per table. 0 to read the whole table.",
+		},
+		&cli.IntFlag{
+			Name:  "top",
+			Value: 10,
+			Usage: "How many most frequent values to consider per column.",
+		},
+		&cli.StringFlag{
+			Name:     "db-url",
+			EnvVars:  []string{"DB_URL"},
+			Usage:    "The connection string used to connect to the source database.",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "db-type",
+			EnvVars:  []string{"DB_TYPE"},
+			Usage:    "The DB type: postgres, mysql or sqlite.",
+			Required: true,
+		},
+	},
+}
+
+var GenerateSQLs = &cli.Command{
+	Name:        "generate-sqls",
+	Description: "Write a new sqls file of the stressConfig of a seed config after the seed is done.",
+	Usage:       "seeder-tester generate-sqls --config config.json --pools-file pools.gob.gz",
+	Action:      seed.GenerateSQLs, //function
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:    "config",
+			Value:   "./config.json",
+			EnvVars: []string{"CONFIG_JSON"},
+			Usage:   "Job Configuration JSON file.",
+		},
+		&cli.PathFlag{
+			Name:    "pools-file",
+			EnvVars: []string{"POOLS_FILE"},
+			Usage:   "The value pools the seed saved to the pools_to_file of the config. Without it the values are sampled from --db-url.",
+		},
+		&cli.PathFlag{
+			Name:    "sqls-file",
+			EnvVars: []string{"SQLS_FILE"},
+			Usage:   "File to write the SQLs to instead of the sqls_to_file of the config.",
+		},
+		&cli.IntFlag{
+			Name:  "sample",
+			Usage: "Rows to sample the values of per table. 0 to read the whole table.",
+		},
+		&cli.StringFlag{
+			Name:    "db-url",
+			EnvVars: []string{"DB_URL"},
+			Usage:   "The connection string of the seeded database to sample the values from. Not needed with --pools-file.",
+		},
+		&cli.StringFlag{
+			Name:     "db-type",
+			EnvVars:  []string{"DB_TYPE"},
+			Usage:    "The DB type: postgres, mysql or sqlite. The dialect of the SQLs.",
+			Required: true,
+		},
 	},
 }
@@ -1,13 +1,15 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/urfave/cli/v2"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
 	"log"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,61 +19,169 @@ type Database struct {
 	dbUrl  string
 	dbType string
 	dbi    database
+
+	// the pool the threads of the run share, opened on the first use
+	mu       sync.Mutex
+	opened   bool
+	poolOpts PoolOptions
 }
 
+// RowSource yields the field values of the next row to insert, false once the rows are exhausted.
+// The seeder generates the rows on the fly, so nothing but the current row is kept in memory.
+type RowSource func() ([]any, bool)
+
 type Task struct {
-	SQLID string
-	SQL   string
+	SQLID   string
+	SQL     string
+	Args    []any         // the bind variables of a prepared SQL, nil for a literal SQL
+	Timeout time.Duration // the SQL is cancelled once it runs for longer, 0 for no limit
+	// the SQL runs as a query and another row count is an error
+	ExpectRows *int
+	// the statements of a transaction task, SQL is empty then
+	Steps []Step
+	// a transaction aborted by a serialization failure or a deadlock is run again up to Retries times
+	Retries int
 }
 
 var POISON_TASK = Task{
-	"NONE",
-	stats.POISON_PILL,
+	SQLID: "NONE",
+	SQL:   stats.POISON_PILL,
 }
 
 type database interface {
-	connect(cc *cli.Context) error
+	connect(cc *cli.Context, opts PoolOptions) error // opens the pool the threads share
 	close(cc *cli.Context) error
-	buildInsert(table string, fields []string) string
-	exec(cc *cli.Context, sql string, arguments []any) error
-	execLiteral(cc *cli.Context, sql string) error
+	acquire(cc *cli.Context) (session, error)                // checks a connection out of the pool
+	dial(cc *cli.Context, opts PoolOptions) (session, error) // opens a connection of its own, release closes it
+	bindVar(i int) string                                    // the placeholder of the i-th, 0 based, bind variable
+	buildInsert(table string, fields []string, values []string, conflict Conflict) string
+	buildTruncate(table string) string
+	buildLength(expr string) string
+	quoteString(s string) string
+	createIndex(cc *cli.Context, s session, table string, name string, index Index) error
+	describeTable(cc *cli.Context, s session, table string) (*TableInfo, error)
+	retryable(err error) bool // the error aborted the transaction and running it again may succeed
 }
 
+// SeedTable inserts the rows on one thread. With CommitEvery > 0 every CommitEvery inserts go in one
+// transaction and the commit time goes to stats under its own commit ID. If an insert fails, the transaction,
+// if any, is rolled back, a failed commit has ended it already, and the thread stops, reporting the failure to stats.
+// The rows it has not committed are missing from the progress, so the seed fails the table.
+// The conflict mode decides what happens to the rows violating a unique key, the outcomes are counted in stats.
 func (db *Database) SeedTable(cc *cli.Context,
 	threadID string,
 	table string,
 	fields []string,
-	fieldValues []map[string]any,
+	rows RowSource,
+	opts InsertOptions,
 	statsChan chan stats.OneStatement,
 	wg *sync.WaitGroup,
 ) {
-	sqlStatement := db.dbi.buildInsert(table, fields)
-	err := db.dbi.connect(cc)
-	if err != nil {
-		log.Fatalf("failed to connect to db %s error %s\n", db.dbUrl, err.Error())
+	defer wg.Done()
+	commitEvery := opts.CommitEvery
+	sqlStatement := db.dbi.buildInsert(table, fields, bindVars(db.dbi, len(fields)), opts.Conflict)
+	if err := db.open(cc); err != nil {
+		log.Fatal(err)
 	}
-	defer func() { db.dbi.close(cc); wg.Done() }()
+	// cc.Context is cancelled on interruption, the statements in flight run on
+	dcc := detach(cc)
 
 	count := 0
+	inTx := 0 // inserts in the open transaction
+	// the connection is checked out of the pool for an insert, or for a transaction with commitEvery
+	var s session
+	var wait time.Duration
+	defer func() {
+		if s != nil {
+			s.release()
+		}
+	}()
 
-	for _, m := range fieldValues {
-		vals := make([]any, len(m))
-		for j, f := range fields {
-			vals[j] = m[f]
+	// report tells stats the statement that failed and stopped the thread
+	report := func(id string, sql string, duration time.Duration, err error) {
+		slog.Error("seeding stopped", "table", table, "thread", threadID,
+			"inserted", count-inTx, "rolledBack", inTx, "error", err)
+		statsChan <- stats.OneStatement{
+			ID:       id,
+			ThreadID: threadID,
+			SQL:      sql,
+			Duration: duration,
+			Err:      err,
 		}
+	}
+	// fail rolls back the open transaction and reports the statement that failed
+	fail := func(id string, sql string, duration time.Duration, err error) {
+		if commitEvery > 0 {
+			if rbErr := s.rollback(dcc); rbErr != nil {
+				slog.Error("rollback failed", "table", table, "thread", threadID, "error", rbErr)
+			}
+		}
+		report(id, sql, duration, err)
+	}
 
+	commit := func() bool {
 		start := time.Now()
-		// log.Print(sqlStatement, vals, "\n")
-		err := db.dbi.exec(cc, sqlStatement, vals)
-		if err != nil {
-			log.Fatalf("failed to insert %s %v\n", sqlStatement, err)
+		if err := s.commit(dcc); err != nil {
+			// a failed commit ends the transaction, there is nothing to roll back
+			report("commit-in-table"+table, "COMMIT", time.Since(start), err)
+			return false
+		}
+		statsChan <- stats.OneStatement{
+			ID:       "commit-in-table" + table,
+			ThreadID: threadID,
+			SQL:      fmt.Sprintf("COMMIT %d inserts", inTx),
+			Duration: time.Since(start),
+		}
+		s.release()
+		s = nil
+		inTx = 0
+		if opts.Progress != nil {
+			opts.Progress(count)
 		}
+		return true
+	}
 
-		count++
-		if count%1000 == 0 {
-			slog.Info("inserts", "table", table, "thread", threadID, "count", count)
+	for {
+		// on interruption the rows inserted so far are committed, so the seed can be resumed
+		if cc.Context.Err() != nil {
+			slog.Warn("seeding interrupted", "table", table, "thread", threadID, "inserted", count)
+			if inTx > 0 {
+				commit()
+			}
+			return
+		}
+
+		vals, ok := rows()
+		if !ok {
+			if inTx > 0 {
+				commit()
+			}
+			return
+		}
+
+		// the wait for a token is not a part of the insert time.
+		// Only the interruption stops it, the row is left to the resume.
+		if err := opts.wait(cc.Context); err != nil {
+			continue
+		}
+
+		if s == nil {
+			var err error
+			if s, wait, err = db.acquire(dcc); err != nil {
+				report("insert-in-table"+table, "CONNECT", wait, fmt.Errorf("failed to get a connection to db %s: %w", db.dbUrl, err))
+				return
+			}
+			if commitEvery > 0 {
+				if err := s.begin(dcc); err != nil {
+					report("insert-in-table"+table, "BEGIN", 0, fmt.Errorf("failed to begin a transaction on %s: %w", table, err))
+					return
+				}
+			}
 		}
 
+		start := time.Now()
+		// log.Print(sqlStatement, vals, "\n")
+		outcome, err := s.insert(dcc, sqlStatement, vals, opts.Conflict.Mode)
 		duration := time.Since(start)
 		sqlWithValues := sqlStatement + "   "
 		for _, v := range vals {
@@ -83,27 +193,84 @@ func (db *Database) SeedTable(cc *cli.Context,
 			}
 		}
 
+		if err != nil {
+			fail("insert-in-table"+table, sqlWithValues, duration, err)
+			return
+		}
+
+		count++
+		if count%1000 == 0 {
+			slog.Info("inserts", "table", table, "thread", threadID, "count", count)
+		}
+
 		statsChan <- stats.OneStatement{
-			ID:       "insert-in-table" + table,
-			ThreadID: threadID,
-			SQL:      sqlWithValues,
-			Duration: duration,
+			ID:         "insert-in-table" + table,
+			ThreadID:   threadID,
+			SQL:        sqlWithValues,
+			Duration:   duration,
+			Wait:       wait,
+			Outcome:    outcome,
+			TargetRate: opts.TargetRate,
+		}
+		wait = 0
+
+		if commitEvery <= 0 {
+			s.release()
+			s = nil
+			if opts.Progress != nil {
+				opts.Progress(count)
+			}
+			continue
+		}
+		inTx++
+		if inTx == commitEvery && !commit() {
+			return
 		}
 	}
 }
 
-func (db *Database) WriteSQLSelect(f *os.File,
-	sqlStatement string,
+func (db *Database) RenderSQLSelect(sqlStatement string,
 	jsonStrings []string,
-	tokens []string) error {
+	tokens []string) (string, error) {
+	return renderSQLSelect(sqlStatement, jsonStrings, tokens), nil
+}
 
+func renderSQLSelect(sqlStatement string,
+	jsonStrings []string,
+	tokens []string) string {
+
+	// one occurrence per token, in order, the bind variables of a placeholder repeated go with their own args
 	outSQL := sqlStatement
 	for j, js := range jsonStrings {
-		outSQL = strings.ReplaceAll(outSQL, js, tokens[j])
+		outSQL = strings.Replace(outSQL, js, tokens[j], 1)
 	}
+	return outSQL
+}
+
+// BindVar is the placeholder of the i-th, 0 based, bind variable of the db type
+func (db *Database) BindVar(i int) string {
+	return db.dbi.bindVar(i)
+}
 
-	_, err := f.WriteString(outSQL + "\n")
-	return err
+// Literal renders a value as an SQL literal of the db type, for the SQLs written to the stress file
+func (db *Database) Literal(v any) string {
+	return sqlLiteral(db.dbi, v)
+}
+
+// sqlLiteral renders a row value as an SQL literal of the dialect,
+// doubling the quotes when there is no dialect
+func sqlLiteral(dbi database, v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int:
+		return strconv.Itoa(v)
+	}
+	s := fmt.Sprint(v)
+	if dbi == nil {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return dbi.quoteString(s)
 }
 
 type countFile struct {
@@ -111,18 +278,31 @@ type countFile struct {
 	f     *os.File
 }
 
-// reading SQL from the channel until it reads the poison pill
+// reading SQL from the channel until it reads the poison pill.
+// Each SQL runs on a connection checked out of the shared pool for it.
+// With --reconnect-every N the thread opens a connection of its own every N SQLs instead,
+// and the connect time goes to stats under its own connect ID.
 func (db *Database) RunSQLs(cc *cli.Context,
 	threadID string,
 	statsChan chan stats.OneStatement,
 	wg *sync.WaitGroup,
 	sql chan Task) {
 
-	err := db.dbi.connect(cc)
-	if err != nil {
-		log.Fatalf("failed to connect to db %s %s", db.dbUrl, err.Error())
+	defer wg.Done()
+	reconnectEvery := cc.Int("reconnect-every")
+	if reconnectEvery <= 0 {
+		if err := db.open(cc); err != nil {
+			log.Fatal(err)
+		}
 	}
-	defer func() { db.dbi.close(cc); wg.Done() }()
+
+	// the connection of the churn mode
+	var own session
+	defer func() {
+		if own != nil {
+			own.release()
+		}
+	}()
 
 	count := 0
 	for {
@@ -131,21 +311,60 @@ func (db *Database) RunSQLs(cc *cli.Context,
 			if task.SQL == stats.POISON_PILL {
 				return
 			}
+			// interrupted: the SQLs left in the channel are not run
+			if cc.Context.Err() != nil {
+				continue
+			}
+
+			var s session
+			var wait time.Duration
+			var err error
+			if reconnectEvery > 0 {
+				if own == nil || count%reconnectEvery == 0 {
+					own, err = db.reconnect(cc, threadID, task.SQLID, own, statsChan)
+				}
+				s = own
+			} else if s, wait, err = db.acquire(cc); err != nil {
+				if cc.Context.Err() != nil {
+					// interrupted while waiting for a connection
+					continue
+				}
+				log.Fatalf("failed to get a connection to db %s: %v", db.dbUrl, err)
+			}
 
-			start := time.Now()
-			db.dbi.execLiteral(cc, task.SQL)
+			var duration time.Duration
+			timedOut := false
+			outcome := ""
+			if s != nil {
+				tcc, cancel := withTimeout(cc, task.Timeout)
+				start := time.Now()
+				if len(task.Steps) > 0 {
+					outcome, err = db.runTransaction(tcc, threadID, s, task, statsChan)
+				} else {
+					err = runStatement(tcc, s, task.SQL, task.Args, task.ExpectRows)
+				}
+				duration = time.Since(start)
+				timedOut = isTimeout(tcc, err)
+				cancel()
+				if reconnectEvery <= 0 {
+					s.release()
+				}
+			}
 
 			count++
 			// fmt.Printf("Count %d Thread %s\n", count, threadID)
 			if count%100 == 0 {
 				slog.Info(fmt.Sprintf("%s made %d queries. Current SQLID is %s", threadID, count, task.SQLID))
 			}
-			duration := time.Since(start)
 			statsChan <- stats.OneStatement{
 				ID:       task.SQLID,
 				ThreadID: threadID,
-				SQL:      task.SQL,
+				SQL:      task.text(),
 				Duration: duration,
+				Wait:     wait,
+				Err:      err,
+				Outcome:  outcome,
+				Timeout:  timedOut,
 			}
 
 		case <-time.After(1 * time.Second):
@@ -154,6 +373,76 @@ func (db *Database) RunSQLs(cc *cli.Context,
 	}
 }
 
+// runStatement runs a SQL: as a query with the expected row count, prepared with the args or as a literal
+func runStatement(cc *cli.Context, s session, sql string, args []any, expectRows *int) error {
+	switch {
+	case expectRows != nil:
+		rows, err := s.query(cc, sql, args)
+		if err != nil {
+			return err
+		}
+		if len(rows) != *expectRows {
+			return fmt.Errorf("%d rows, expected %d", len(rows), *expectRows)
+		}
+		return nil
+	case args != nil:
+		return s.execPrepared(cc, sql, args)
+	default:
+		return s.execLiteral(cc, sql)
+	}
+}
+
+// detach returns cc with a context that the interruption does not cancel, so the statements in flight finish
+func detach(cc *cli.Context) *cli.Context {
+	dcc := *cc
+	dcc.Context = context.WithoutCancel(cc.Context)
+	return &dcc
+}
+
+// withTimeout returns the context to run a statement with: the interruption lets it finish,
+// but it is cancelled after the timeout if it's > 0.
+// pgx and sqlite3 cancel the running query on the server, the MySQL driver only drops the connection.
+func withTimeout(cc *cli.Context, timeout time.Duration) (*cli.Context, context.CancelFunc) {
+	tcc := detach(cc)
+	if timeout <= 0 {
+		return tcc, func() {}
+	}
+	var cancel context.CancelFunc
+	tcc.Context, cancel = context.WithTimeout(tcc.Context, timeout)
+	return tcc, cancel
+}
+
+// isTimeout tells if the statement, or a step of the transaction, failed for running out of its timeout
+func isTimeout(cc *cli.Context, err error) bool {
+	return err != nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(cc.Context.Err(), context.DeadlineExceeded))
+}
+
+// reconnect closes the connection of the churn mode and opens a new one, reporting the connect time.
+// If the connect fails the error goes to stats and the SQL it was for fails with it.
+func (db *Database) reconnect(cc *cli.Context, threadID string, sqlID string, old session, statsChan chan stats.OneStatement) (session, error) {
+	if old != nil {
+		old.release()
+	}
+	connect := "CONNECT"
+	if cc.Bool("tls") {
+		connect += " TLS"
+	}
+
+	start := time.Now()
+	s, err := db.dbi.dial(cc, db.poolOpts)
+	statsChan <- stats.OneStatement{
+		ID:       "connect-for-sql" + sqlID,
+		ThreadID: threadID,
+		SQL:      connect,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to db %s: %w", db.dbUrl, err)
+	}
+	return s, nil
+}
+
 func New(dbType string, dbUrl string) *Database {
 	var db database
 	switch dbType {
@@ -161,6 +450,8 @@ func New(dbType string, dbUrl string) *Database {
 		db = newPg()
 	case "mysql":
 		db = newMYSQL()
+	case "sqlite":
+		db = newSQLite()
 	}
 
 	return &Database{
@@ -1,50 +1,190 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/urfave/cli/v2"
 	"strings"
 )
 
+// https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+const erDupKeyname = 1061
+const erLockWaitTimeout = 1205
+const erLockDeadlock = 1213
+
 type mySQL struct {
 	mySqlConn *sqlx.DB
+	stmts     *stmtCache
 }
 
-func (db *mySQL) connect(cc *cli.Context) error {
-	var err error
-	db.mySqlConn, err = sqlx.Connect("mysql", cc.String("db-url"))
+func (db *mySQL) connect(cc *cli.Context, opts PoolOptions) error {
+	dsn, err := mySQLDSN(cc)
+	if err != nil {
+		return err
+	}
+	db.stmts = newStmtCache(opts.StmtCache)
+	db.mySqlConn, err = openSQLX(cc, "mysql", dsn, opts, db.stmts)
 	return err
 }
 
+func (db *mySQL) acquire(cc *cli.Context) (session, error) {
+	return acquireSQLX(cc, db.mySqlConn, db.stmts, mySQLOutcome)
+}
+
+func (db *mySQL) dial(cc *cli.Context, opts PoolOptions) (session, error) {
+	dsn, err := mySQLDSN(cc)
+	if err != nil {
+		return nil, err
+	}
+	return dialSQLX(cc, "mysql", dsn, opts, mySQLOutcome)
+}
+
+// mySQLDSN is the db-url, with TLS not verifying the server certificate if --tls is set
+func mySQLDSN(cc *cli.Context) (string, error) {
+	if !cc.Bool("tls") {
+		return cc.String("db-url"), nil
+	}
+	config, err := mysql.ParseDSN(cc.String("db-url"))
+	if err != nil {
+		return "", err
+	}
+	config.TLSConfig = "skip-verify"
+	return config.FormatDSN(), nil
+}
+
+// a deadlock rolls the transaction back, InnoDB has no serialization failure of its own.
+// A lock wait timeout rolls back the statement only, the transaction is rolled back to be retried as a whole.
+func (db *mySQL) retryable(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && (myErr.Number == erLockDeadlock || myErr.Number == erLockWaitTimeout)
+}
+
 func (db *mySQL) close(cc *cli.Context) error {
 	if db.mySqlConn != nil {
+		db.stmts.close()
 		return db.mySqlConn.Close()
 	}
 	return fmt.Errorf("db connection is nil")
 }
 
-func (db *mySQL) buildInsert(table string, fields []string) string {
-	sqlStatement := "INSERT INTO " + table + " ("
-	for _, f := range fields {
-		sqlStatement += f + ","
+func (db *mySQL) bindVar(i int) string {
+	return "?"
+}
+
+// INSERT IGNORE turns the other errors, like a too long value, into warnings as well
+func (db *mySQL) buildInsert(table string, fields []string, values []string, conflict Conflict) string {
+	switch conflict.Mode {
+	case ConflictIgnore:
+		return insertInto("INSERT IGNORE", table, fields, values)
+	case ConflictUpdate:
+		set := make([]string, 0, len(fields))
+		for _, f := range conflict.updated(fields) {
+			set = append(set, f+" = VALUES("+f+")")
+		}
+		return insertInto("INSERT", table, fields, values) + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
 	}
-	sqlStatement = sqlStatement[:len(sqlStatement)-1] + ") VALUES ("
+	return insertInto("INSERT", table, fields, values)
+}
 
-	sqlStatement += strings.Repeat("?,", len(fields))
-	return sqlStatement[:len(sqlStatement)-1] + ")"
+func (db *mySQL) buildTruncate(table string) string {
+	return "TRUNCATE TABLE " + table
 }
 
-func (db *mySQL) exec(cc *cli.Context, query string, args []any) error {
-	_, err := db.mySqlConn.ExecContext(cc.Context, query, args...)
-	return err
+// LENGTH is in bytes in MySQL
+func (db *mySQL) buildLength(expr string) string {
+	return "CHAR_LENGTH(" + expr + ")"
 }
 
-func (db *mySQL) execLiteral(cc *cli.Context, query string) error {
-	_, err := db.mySqlConn.ExecContext(cc.Context, query)
+var mySQLEscaper = strings.NewReplacer(`\`, `\\`, `'`, `''`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// backslash is an escape character in MySQL strings unless NO_BACKSLASH_ESCAPES is set
+func (db *mySQL) quoteString(s string) string {
+	return "'" + mySQLEscaper.Replace(s) + "'"
+}
+
+// MySQL has no CREATE INDEX IF NOT EXISTS, so an index that is already there is not an error
+func (db *mySQL) createIndex(cc *cli.Context, s session, table string, name string, index Index) error {
+	err := s.execLiteral(cc, buildCreateIndex(table, name, index, false))
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == erDupKeyname {
+		return nil
+	}
 	return err
 }
 
+// the affected rows tell the outcome: 1 for a new row, 2 for an updated one, 0 for an ignored
+// or an updated to the same values one, unless the DSN sets clientFoundRows
+func mySQLOutcome(res sql.Result, mode string) (string, error) {
+	n, err := res.RowsAffected()
+	switch {
+	case err != nil:
+		return "", err
+	case n == 1:
+		return OutcomeInserted, nil
+	case mode == ConflictUpdate:
+		return OutcomeUpdated, nil
+	default:
+		return OutcomeSkipped, nil
+	}
+}
+
+func (db *mySQL) describeTable(cc *cli.Context, s session, table string) (*TableInfo, error) {
+	info := &TableInfo{Table: table}
+	rows, err := s.query(cc, `SELECT column_name, column_type, character_maximum_length, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?
+		ORDER BY ordinal_position`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		info.Columns = append(info.Columns, ColumnInfo{
+			Name:      asString(r[0]),
+			Type:      asString(r[1]),
+			MaxLength: asInt(r[2]),
+			NotNull:   asString(r[3]) == "NO",
+		})
+	}
+
+	rows, err = s.query(cc, `SELECT kcu.column_name, kcu.referenced_table_name, kcu.referenced_column_name
+		FROM information_schema.key_column_usage kcu
+		WHERE kcu.table_schema = DATABASE() AND kcu.table_name = ? AND kcu.referenced_table_name IS NOT NULL
+			AND (SELECT count(1) FROM information_schema.key_column_usage k
+				WHERE k.constraint_schema = kcu.constraint_schema AND k.table_name = kcu.table_name
+				AND k.constraint_name = kcu.constraint_name) = 1`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if c := info.column(asString(r[0])); c != nil {
+			c.References = &ForeignKey{Table: asString(r[1]), Column: asString(r[2])}
+		}
+	}
+
+	rows, err = s.query(cc, `SELECT index_name, non_unique, column_name
+		FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ?
+		ORDER BY index_name, seq_in_index`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if asString(r[0]) == "PRIMARY" {
+			if c := info.column(asString(r[2])); c != nil {
+				c.PrimaryKey = true
+			}
+			continue
+		}
+		info.addIndexColumn(asString(r[0]), asInt(r[1]) == 0, asString(r[2]))
+	}
+	info.markUnique()
+
+	return info, nil
+}
+
 func newMYSQL() *mySQL {
 	return &mySQL{}
 }
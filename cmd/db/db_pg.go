@@ -1,30 +1,93 @@
 package db
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/urfave/cli/v2"
+	"strings"
 )
 
 type pg struct {
 	//pgConn *pgx.Conn
-	pgConn *pgxpool.Pool
+	pgConn    *pgxpool.Pool
+	stmtCache bool
 }
 
 // https://github.com/jackc/pgx/wiki/Getting-started-with-pgx#using-a-connection-pool
 
-func (db *pg) connect(cc *cli.Context) error {
-	var err error
+// pgConn is what pgSession needs of a pooled connection or of a connection of its own
+type pgConn interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// pgSession is a connection checked out of the pool or dialed for the churn mode
+type pgSession struct {
+	conn  pgConn
+	tx    pgx.Tx // the open transaction the statements go to, nil in autocommit
+	close func() // releases the connection to the pool or closes it
+	cache bool   // execPrepared keeps the statements in the pgx statement cache of the connection
+}
+
+// pgConfig makes the connection use TLS with --tls, not verifying the server certificate like sslmode=require,
+// and run the session init statements once connected
+func pgConfig(cc *cli.Context, config *pgconn.Config, sessionInit []string) {
+	if cc.Bool("tls") {
+		config.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		config.Fallbacks = nil
+	}
+	if len(sessionInit) == 0 {
+		return
+	}
+	config.AfterConnect = func(ctx context.Context, conn *pgconn.PgConn) error {
+		for _, q := range sessionInit {
+			if _, err := conn.Exec(ctx, q).ReadAll(); err != nil {
+				return fmt.Errorf("session init %s: %w", q, err)
+			}
+		}
+		return nil
+	}
+}
+
+func (db *pg) connect(cc *cli.Context, opts PoolOptions) error {
 	// getting
 	// {"error":"conn busy","message":"failed to insert INSERT INTO table_1 (a,b) VALUES ($1,$2)"}
-	// pgx.Connect() represents a single connection and is not concurrency safe.
-	// however, we don't use this connection concurrently. Each threads does open
-	// so it's unclear to me why this does not work
-	//db.pgConn, err = pgx.Connect(cc.Context, cc.String("db-url"))
-	db.pgConn, err = pgxpool.New(cc.Context, cc.String("db-url"))
+	// pgx.Connect() represents a single connection and is not concurrency safe,
+	// so the threads share the pool and check a connection out of it per unit of work
+	config, err := pgxpool.ParseConfig(cc.String("db-url"))
+	if err != nil {
+		return err
+	}
+	pgConfig(cc, &config.ConnConfig.Config, opts.SessionInit)
+	if opts.StmtCache > 0 {
+		config.ConnConfig.StatementCacheCapacity = opts.StmtCache
+	}
+	db.stmtCache = opts.StmtCache > 0
+	config.MaxConns = int32(opts.MaxConns)
+	config.MinConns = int32(opts.MinConns)
+	if opts.IdleTimeout > 0 {
+		config.MaxConnIdleTime = opts.IdleTimeout
+	}
+	if opts.MaxLifetime > 0 {
+		config.MaxConnLifetime = opts.MaxLifetime
+	}
+	db.pgConn, err = pgxpool.NewWithConfig(cc.Context, config)
 	return err
 }
 
+// serialization_failure and deadlock_detected
+func (db *pg) retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
 func (db *pg) close(cc *cli.Context) error {
 	if db.pgConn != nil {
 		// return db.pgConn.Close(cc.Context)
@@ -34,28 +97,245 @@ func (db *pg) close(cc *cli.Context) error {
 	return fmt.Errorf("db connection is nil")
 }
 
-func (db *pg) buildInsert(table string, fields []string) string {
-	sqlStatement := "INSERT INTO " + table + " ("
-	for _, f := range fields {
-		sqlStatement += f + ","
+func (db *pg) acquire(cc *cli.Context) (session, error) {
+	conn, err := db.pgConn.Acquire(cc.Context)
+	if err != nil {
+		return nil, err
+	}
+	return &pgSession{conn: conn, close: conn.Release, cache: db.stmtCache}, nil
+}
+
+func (db *pg) dial(cc *cli.Context, opts PoolOptions) (session, error) {
+	config, err := pgx.ParseConfig(cc.String("db-url"))
+	if err != nil {
+		return nil, err
+	}
+	pgConfig(cc, &config.Config, opts.SessionInit)
+	if opts.StmtCache > 0 {
+		config.StatementCacheCapacity = opts.StmtCache
+	}
+	conn, err := pgx.ConnectConfig(cc.Context, config)
+	if err != nil {
+		return nil, err
+	}
+	return &pgSession{conn: conn, close: func() { conn.Close(context.Background()) }, cache: opts.StmtCache > 0}, nil
+}
+
+func (db *pg) bindVar(i int) string {
+	return "$" + fmt.Sprint(i+1)
+}
+
+func (db *pg) buildInsert(table string, fields []string, values []string, conflict Conflict) string {
+	sqlStatement := insertInto("INSERT", table, fields, values)
+	switch conflict.Mode {
+	case ConflictIgnore:
+		sqlStatement += " ON CONFLICT DO NOTHING"
+	case ConflictUpdate:
+		set := make([]string, 0, len(fields))
+		for _, f := range conflict.updated(fields) {
+			set = append(set, f+" = EXCLUDED."+f)
+		}
+		sqlStatement += " ON CONFLICT (" + strings.Join(conflict.Keys, ",") + ") DO UPDATE SET " + strings.Join(set, ", ")
+	}
+	return sqlStatement
+}
+
+func (db *pg) buildTruncate(table string) string {
+	return "TRUNCATE TABLE " + table
+}
+
+func (db *pg) buildLength(expr string) string {
+	return "length(" + expr + ")"
+}
+
+// standard conforming strings: the quote is the only character to escape
+func (db *pg) quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (db *pg) createIndex(cc *cli.Context, s session, table string, name string, index Index) error {
+	return s.execLiteral(cc, buildCreateIndex(table, name, index, true))
+}
+
+func (s *pgSession) execTag(cc *cli.Context, query string, args []any) (pgconn.CommandTag, error) {
+	if s.tx != nil {
+		return s.tx.Exec(cc.Context, query, args...)
+	}
+	return s.conn.Exec(cc.Context, query, args...)
+}
+
+func (s *pgSession) exec(cc *cli.Context, query string, args []any) error {
+	_, err := s.execTag(cc, query, args)
+	return err
+}
+
+func (s *pgSession) insert(cc *cli.Context, query string, args []any, mode string) (string, error) {
+	// (xmax = 0) is true for a new row and false for an updated one
+	if mode == ConflictUpdate {
+		var row pgx.Row
+		if s.tx != nil {
+			row = s.tx.QueryRow(cc.Context, query+" RETURNING (xmax = 0)", args...)
+		} else {
+			row = s.conn.QueryRow(cc.Context, query+" RETURNING (xmax = 0)", args...)
+		}
+		var inserted bool
+		if err := row.Scan(&inserted); err != nil {
+			return "", err
+		}
+		if inserted {
+			return OutcomeInserted, nil
+		}
+		return OutcomeUpdated, nil
 	}
-	sqlStatement = sqlStatement[:len(sqlStatement)-1] + ") VALUES ("
-	for i := range fields {
-		sqlStatement += "$" + fmt.Sprint(i+1) + ","
+
+	tag, err := s.execTag(cc, query, args)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return OutcomeSkipped, nil
+	}
+	return OutcomeInserted, nil
+}
+
+// execLiteral sends the SQL as is over the simple protocol, so the server parses and plans each one
+func (s *pgSession) execLiteral(cc *cli.Context, query string) error {
+	return s.exec(cc, query, []any{pgx.QueryExecModeSimpleProtocol})
+}
+
+// execPrepared runs the statement over the extended protocol: prepared once per connection
+// with the statement cache, otherwise described and prepared for each execution
+func (s *pgSession) execPrepared(cc *cli.Context, query string, args []any) error {
+	mode := pgx.QueryExecModeDescribeExec
+	if s.cache {
+		mode = pgx.QueryExecModeCacheStatement
 	}
-	return sqlStatement[:len(sqlStatement)-1] + ")"
+	return s.exec(cc, query, append([]any{mode}, args...))
+}
+
+func (s *pgSession) begin(cc *cli.Context) error {
+	var err error
+	s.tx, err = s.conn.Begin(cc.Context)
+	return err
 }
 
-func (db *pg) exec(cc *cli.Context, query string, args []any) error {
-	_, err := db.pgConn.Exec(cc.Context, query, args...)
+func (s *pgSession) commit(cc *cli.Context) error {
+	err := s.tx.Commit(cc.Context)
+	s.tx = nil
 	return err
 }
 
-func (db *pg) execLiteral(cc *cli.Context, query string) error {
-	_, err := db.pgConn.Exec(cc.Context, query)
+// rollback is a no-op once the transaction is over, like after a failed commit
+func (s *pgSession) rollback(cc *cli.Context) error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback(cc.Context)
+	s.tx = nil
 	return err
 }
 
+// release returns the connection to the pool or closes it, rolling back the transaction left open
+func (s *pgSession) release() {
+	if s.tx != nil {
+		s.tx.Rollback(context.Background())
+		s.tx = nil
+	}
+	s.close()
+}
+
+func (s *pgSession) query(cc *cli.Context, query string, args []any) ([][]any, error) {
+	var rows pgx.Rows
+	var err error
+	if s.tx != nil {
+		rows, err = s.tx.Query(cc.Context, query, args...)
+	} else {
+		rows, err = s.conn.Query(cc.Context, query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret [][]any
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, vals)
+	}
+	return ret, rows.Err()
+}
+
+func (db *pg) describeTable(cc *cli.Context, s session, table string) (*TableInfo, error) {
+	info := &TableInfo{Table: table}
+	rows, err := s.query(cc, `SELECT column_name, data_type, character_maximum_length, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		ORDER BY ordinal_position`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		c := ColumnInfo{
+			Name:      asString(r[0]),
+			Type:      asString(r[1]),
+			MaxLength: asInt(r[2]),
+			NotNull:   asString(r[3]) == "NO",
+		}
+		if c.MaxLength > 0 {
+			c.Type = fmt.Sprintf("%s(%d)", c.Type, c.MaxLength)
+		}
+		info.Columns = append(info.Columns, c)
+	}
+
+	// single column foreign keys and the primary key
+	rows, err = s.query(cc, `SELECT tc.constraint_type, kcu.column_name, ccu.table_name, ccu.column_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+			ON kcu.constraint_schema = tc.constraint_schema AND kcu.constraint_name = tc.constraint_name
+		LEFT JOIN information_schema.constraint_column_usage ccu
+			ON tc.constraint_type = 'FOREIGN KEY' AND ccu.constraint_schema = tc.constraint_schema AND ccu.constraint_name = tc.constraint_name
+		WHERE tc.table_schema = current_schema() AND tc.table_name = $1 AND tc.constraint_type IN ('PRIMARY KEY', 'FOREIGN KEY')
+			AND (tc.constraint_type = 'PRIMARY KEY' OR (SELECT count(1) FROM information_schema.key_column_usage k
+				WHERE k.constraint_schema = tc.constraint_schema AND k.constraint_name = tc.constraint_name) = 1)
+		ORDER BY kcu.ordinal_position`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		c := info.column(asString(r[1]))
+		if c == nil {
+			continue
+		}
+		if asString(r[0]) == "PRIMARY KEY" {
+			c.PrimaryKey = true
+			continue
+		}
+		c.References = &ForeignKey{Table: asString(r[2]), Column: asString(r[3])}
+	}
+
+	// indexes are not in information_schema
+	rows, err = s.query(cc, `SELECT i.relname, ix.indisunique, a.attname
+		FROM pg_catalog.pg_index ix
+		JOIN pg_catalog.pg_class t ON t.oid = ix.indrelid
+		JOIN pg_catalog.pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(ix.indkey)
+		WHERE t.relname = $1 AND t.relnamespace = current_schema()::regnamespace AND NOT ix.indisprimary
+		ORDER BY i.relname, array_position(ix.indkey::int2[], a.attnum)`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		unique, _ := r[1].(bool)
+		info.addIndexColumn(asString(r[0]), unique, asString(r[2]))
+	}
+	info.markUnique()
+
+	return info, nil
+}
+
 func newPg() *pg {
 	return &pg{}
 }
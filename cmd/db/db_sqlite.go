@@ -0,0 +1,149 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/urfave/cli/v2"
+	"regexp"
+	"strings"
+)
+
+type sqlite struct {
+	sqliteConn *sqlx.DB
+	stmts      *stmtCache
+}
+
+// db-url is the database file path or a file: URI, e.g. file:seed.db?_journal_mode=WAL&_busy_timeout=5000
+func (db *sqlite) connect(cc *cli.Context, opts PoolOptions) error {
+	if cc.Bool("tls") {
+		return fmt.Errorf("no TLS for sqlite, it is a local file")
+	}
+	var err error
+	db.stmts = newStmtCache(opts.StmtCache)
+	db.sqliteConn, err = openSQLX(cc, "sqlite3", cc.String("db-url"), opts, db.stmts)
+	return err
+}
+
+func (db *sqlite) acquire(cc *cli.Context) (session, error) {
+	return acquireSQLX(cc, db.sqliteConn, db.stmts, sqliteOutcome)
+}
+
+func (db *sqlite) dial(cc *cli.Context, opts PoolOptions) (session, error) {
+	if cc.Bool("tls") {
+		return nil, fmt.Errorf("no TLS for sqlite, it is a local file")
+	}
+	return dialSQLX(cc, "sqlite3", cc.String("db-url"), opts, sqliteOutcome)
+}
+
+// another connection holds the lock the transaction needs
+func (db *sqlite) retryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+func (db *sqlite) close(cc *cli.Context) error {
+	if db.sqliteConn != nil {
+		db.stmts.close()
+		return db.sqliteConn.Close()
+	}
+	return fmt.Errorf("db connection is nil")
+}
+
+func (db *sqlite) bindVar(i int) string {
+	return "?"
+}
+
+// INSERT OR REPLACE deletes the conflicting rows and inserts the new one
+func (db *sqlite) buildInsert(table string, fields []string, values []string, conflict Conflict) string {
+	switch conflict.Mode {
+	case ConflictIgnore:
+		return insertInto("INSERT OR IGNORE", table, fields, values)
+	case ConflictUpdate:
+		return insertInto("INSERT OR REPLACE", table, fields, values)
+	}
+	return insertInto("INSERT", table, fields, values)
+}
+
+// SQLite has no TRUNCATE
+func (db *sqlite) buildTruncate(table string) string {
+	return "DELETE FROM " + table
+}
+
+func (db *sqlite) buildLength(expr string) string {
+	return "length(" + expr + ")"
+}
+
+// standard conforming strings: the quote is the only character to escape
+func (db *sqlite) quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (db *sqlite) createIndex(cc *cli.Context, s session, table string, name string, index Index) error {
+	return s.execLiteral(cc, buildCreateIndex(table, name, index, true))
+}
+
+// INSERT OR REPLACE counts the replaced rows as inserted
+func sqliteOutcome(res sql.Result, mode string) (string, error) {
+	if mode == ConflictUpdate {
+		return OutcomeUpserted, nil
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return OutcomeInserted, err
+	}
+	return OutcomeSkipped, nil
+}
+
+var typeLength = regexp.MustCompile(`\((\d+)\)`)
+
+// SQLite has no information_schema, the pragma table valued functions tell the same
+func (db *sqlite) describeTable(cc *cli.Context, s session, table string) (*TableInfo, error) {
+	info := &TableInfo{Table: table}
+	rows, err := s.query(cc, `SELECT name, type, "notnull", pk FROM pragma_table_info(?) ORDER BY cid`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		c := ColumnInfo{
+			Name:       asString(r[0]),
+			Type:       asString(r[1]),
+			NotNull:    asInt(r[2]) == 1,
+			PrimaryKey: asInt(r[3]) > 0,
+		}
+		if m := typeLength.FindStringSubmatch(c.Type); m != nil {
+			c.MaxLength = asInt(m[1])
+		}
+		info.Columns = append(info.Columns, c)
+	}
+
+	rows, err = s.query(cc, `SELECT "from", "table", "to" FROM pragma_foreign_key_list(?)
+		WHERE id IN (SELECT id FROM pragma_foreign_key_list(?) GROUP BY id HAVING count(1) = 1)`, []any{table, table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if c := info.column(asString(r[0])); c != nil {
+			c.References = &ForeignKey{Table: asString(r[1]), Column: asString(r[2])}
+		}
+	}
+
+	rows, err = s.query(cc, `SELECT il.name, il."unique", ii.name
+		FROM pragma_index_list(?) il JOIN pragma_index_info(il.name) ii
+		WHERE il.origin <> 'pk'
+		ORDER BY il.name, ii.seqno`, []any{table})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		info.addIndexColumn(asString(r[0]), asInt(r[1]) == 1, asString(r[2]))
+	}
+	info.markUnique()
+
+	return info, nil
+}
+
+func newSQLite() *sqlite {
+	return &sqlite{}
+}
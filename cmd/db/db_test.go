@@ -0,0 +1,580 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSession records the statements run on it, failing the ones fail returns an error for.
+// Like the sessions of the drivers it ends the transaction on commit, failed or not.
+type mockSession struct {
+	sqls     []string
+	fail     func(sql string) error
+	released bool
+	tx       bool // a transaction is open
+}
+
+func (s *mockSession) run(sql string) error {
+	s.sqls = append(s.sqls, sql)
+	if s.fail != nil {
+		return s.fail(sql)
+	}
+	return nil
+}
+
+func (s *mockSession) exec(cc *cli.Context, sql string, arguments []any) error {
+	return s.run(sql)
+}
+
+func (s *mockSession) insert(cc *cli.Context, sql string, arguments []any, conflictMode string) (string, error) {
+	return OutcomeInserted, s.run(sql)
+}
+
+func (s *mockSession) execLiteral(cc *cli.Context, sql string) error {
+	return s.run(sql)
+}
+
+func (s *mockSession) execPrepared(cc *cli.Context, sql string, arguments []any) error {
+	return s.run(sql)
+}
+
+func (s *mockSession) query(cc *cli.Context, sql string, arguments []any) ([][]any, error) {
+	return nil, s.run(sql)
+}
+
+func (s *mockSession) begin(cc *cli.Context) error {
+	err := s.run("BEGIN")
+	s.tx = err == nil
+	return err
+}
+
+func (s *mockSession) commit(cc *cli.Context) error {
+	s.tx = false
+	return s.run("COMMIT")
+}
+
+func (s *mockSession) rollback(cc *cli.Context) error {
+	if !s.tx {
+		s.sqls = append(s.sqls, "ROLLBACK without a transaction")
+		return nil
+	}
+	s.tx = false
+	s.sqls = append(s.sqls, "ROLLBACK")
+	return nil
+}
+
+func (s *mockSession) release() {
+	s.released = true
+}
+
+func Test_schemaSQLs(t *testing.T) {
+	schema := &TableSchema{
+		Columns:    []Column{{Name: "a", Type: "INTEGER", NotNull: true}, {Name: "b", Type: "VARCHAR(10)"}},
+		PrimaryKey: []string{"a"},
+	}
+	create := "CREATE TABLE IF NOT EXISTS t (a INTEGER NOT NULL, b VARCHAR(10), PRIMARY KEY (a))"
+	tests := []struct {
+		name string
+		dbi  database
+		opts SchemaOptions
+		want []string
+	}{
+		{"create", newPg(), SchemaOptions{Create: true}, []string{create}},
+		{"drop existing", newMYSQL(), SchemaOptions{DropExisting: true, Truncate: true}, []string{"DROP TABLE IF EXISTS t", create}},
+		{"pg truncate", newPg(), SchemaOptions{Truncate: true}, []string{"TRUNCATE TABLE t"}},
+		{"mysql truncate", newMYSQL(), SchemaOptions{Create: true, Truncate: true}, []string{create, "TRUNCATE TABLE t"}},
+		{"sqlite truncate", newSQLite(), SchemaOptions{Truncate: true}, []string{"DELETE FROM t"}},
+		{"nothing", newSQLite(), SchemaOptions{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := schemaSQLs(tt.dbi, "t", schema, tt.opts)
+			if len(got) != len(tt.want) {
+				t.Fatalf("schemaSQLs() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("schemaSQLs()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_createIndex(t *testing.T) {
+	unique := Index{Columns: []string{"a", "b"}, Unique: true}
+	named := Index{Name: "t_b", Columns: []string{"b"}}
+	tests := []struct {
+		name  string
+		dbi   database
+		index Index
+		want  string
+	}{
+		{"pg", newPg(), unique, "CREATE UNIQUE INDEX IF NOT EXISTS t_a_b_idx ON t (a,b)"},
+		{"sqlite", newSQLite(), named, "CREATE INDEX IF NOT EXISTS t_b ON t (b)"},
+		// MySQL has no IF NOT EXISTS
+		{"mysql", newMYSQL(), unique, "CREATE UNIQUE INDEX t_a_b_idx ON t (a,b)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &mockSession{}
+			if err := tt.dbi.createIndex(nil, s, "t", tt.index.name("t"), tt.index); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.sqls) != 1 || s.sqls[0] != tt.want {
+				t.Errorf("createIndex() ran %q, want %s", s.sqls, tt.want)
+			}
+		})
+	}
+
+	// the index is already there
+	s := &mockSession{fail: func(string) error { return &mysql.MySQLError{Number: erDupKeyname} }}
+	if err := newMYSQL().createIndex(nil, s, "t", "t_a_b_idx", unique); err != nil {
+		t.Errorf("mysql createIndex() of an existing index error = %v", err)
+	}
+}
+
+func Test_buildInsert(t *testing.T) {
+	fields := []string{"a", "b", "c"}
+	tests := []struct {
+		name     string
+		dbi      database
+		conflict Conflict
+		want     string
+	}{
+		{"pg error", newPg(), Conflict{}, "INSERT INTO t (a,b,c) VALUES ($1,$2,$3)"},
+		{"pg ignore", newPg(), Conflict{Mode: ConflictIgnore}, "INSERT INTO t (a,b,c) VALUES ($1,$2,$3) ON CONFLICT DO NOTHING"},
+		{"pg update", newPg(), Conflict{Mode: ConflictUpdate, Keys: []string{"a"}},
+			"INSERT INTO t (a,b,c) VALUES ($1,$2,$3) ON CONFLICT (a) DO UPDATE SET b = EXCLUDED.b, c = EXCLUDED.c"},
+		{"pg update all key", newPg(), Conflict{Mode: ConflictUpdate, Keys: fields},
+			"INSERT INTO t (a,b,c) VALUES ($1,$2,$3) ON CONFLICT (a,b,c) DO UPDATE SET a = EXCLUDED.a"},
+		{"mysql error", newMYSQL(), Conflict{Mode: ConflictError}, "INSERT INTO t (a,b,c) VALUES (?,?,?)"},
+		{"mysql ignore", newMYSQL(), Conflict{Mode: ConflictIgnore}, "INSERT IGNORE INTO t (a,b,c) VALUES (?,?,?)"},
+		{"mysql update", newMYSQL(), Conflict{Mode: ConflictUpdate, Keys: []string{"a", "b"}},
+			"INSERT INTO t (a,b,c) VALUES (?,?,?) ON DUPLICATE KEY UPDATE c = VALUES(c)"},
+		{"sqlite ignore", newSQLite(), Conflict{Mode: ConflictIgnore}, "INSERT OR IGNORE INTO t (a,b,c) VALUES (?,?,?)"},
+		{"sqlite update", newSQLite(), Conflict{Mode: ConflictUpdate}, "INSERT OR REPLACE INTO t (a,b,c) VALUES (?,?,?)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dbi.buildInsert("t", fields, bindVars(tt.dbi, len(fields)), tt.conflict); got != tt.want {
+				t.Errorf("buildInsert() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// result is the sql.Result of an insert
+type result struct {
+	rows int64
+	err  error
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rows, r.err
+}
+
+func Test_outcome(t *testing.T) {
+	failed := errors.New("no rows affected")
+	tests := []struct {
+		name    string
+		outcome func(res sql.Result, mode string) (string, error)
+		res     result
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{"mysql inserted", mySQLOutcome, result{rows: 1}, ConflictIgnore, OutcomeInserted, false},
+		{"mysql skipped", mySQLOutcome, result{rows: 0}, ConflictIgnore, OutcomeSkipped, false},
+		{"mysql updated", mySQLOutcome, result{rows: 2}, ConflictUpdate, OutcomeUpdated, false},
+		// updated to the same values
+		{"mysql unchanged", mySQLOutcome, result{rows: 0}, ConflictUpdate, OutcomeUpdated, false},
+		{"mysql error", mySQLOutcome, result{err: failed}, ConflictIgnore, "", true},
+		{"sqlite inserted", sqliteOutcome, result{rows: 1}, ConflictIgnore, OutcomeInserted, false},
+		{"sqlite skipped", sqliteOutcome, result{rows: 0}, ConflictIgnore, OutcomeSkipped, false},
+		{"sqlite replaced", sqliteOutcome, result{rows: 1}, ConflictUpdate, OutcomeUpserted, false},
+		{"sqlite error", sqliteOutcome, result{err: failed}, ConflictError, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.outcome(tt.res, tt.mode)
+			if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+				t.Errorf("outcome() = %s, %v, want %s, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_TokenBucket(t *testing.T) {
+	b := NewTokenBucket(100)
+	now := b.last
+	// the burst, a tenth of a second of tokens, goes at once
+	for i := 0; i < 10; i++ {
+		if wait := b.reserve(now); wait > 0 {
+			t.Fatalf("token %d of the burst waits %s", i+1, wait)
+		}
+	}
+	// then the callers queue up a token every 10ms
+	for i := 1; i <= 5; i++ {
+		if wait, want := b.reserve(now), time.Duration(i)*10*time.Millisecond; wait < want-time.Microsecond || wait > want+time.Microsecond {
+			t.Fatalf("queued token %d waits %s, want %s", i, wait, want)
+		}
+	}
+	// a pause refills no more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		if wait := b.reserve(now); wait > 0 {
+			t.Fatalf("token %d after the pause waits %s", i+1, wait)
+		}
+	}
+	if wait := b.reserve(now); wait <= 0 {
+		t.Errorf("a token past the burst does not wait")
+	}
+
+	// a slow rate still has a token to start with
+	b = NewTokenBucket(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := b.Wait(ctx); err == nil {
+		t.Errorf("Wait() for a token a second away returned no error with the context cancelled")
+	}
+}
+
+// mockDatabase dials mockSessions, failing the dials dialErr returns an error for
+type mockDatabase struct {
+	*sqlite
+	sessions []*mockSession
+	dialErr  func(n int) error
+	fail     func(sql string) error // of the sessions acquire checks out
+}
+
+// acquire checks out a mockSession failing per fail
+func (d *mockDatabase) acquire(cc *cli.Context) (session, error) {
+	s := &mockSession{fail: d.fail}
+	d.sessions = append(d.sessions, s)
+	return s, nil
+}
+
+func (d *mockDatabase) dial(cc *cli.Context, opts PoolOptions) (session, error) {
+	if d.dialErr != nil {
+		if err := d.dialErr(len(d.sessions)); err != nil {
+			d.sessions = append(d.sessions, nil)
+			return nil, err
+		}
+	}
+	s := &mockSession{fail: d.fail}
+	d.sessions = append(d.sessions, s)
+	return s, nil
+}
+
+// runSQLs runs the tasks on one thread and returns what it sent to stats
+func runSQLs(t *testing.T, d *mockDatabase, reconnectEvery int, tasks []Task) []stats.OneStatement {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.Int("reconnect-every", reconnectEvery, "")
+	cc := cli.NewContext(cli.NewApp(), fs, nil)
+	cc.Context = context.Background()
+
+	db := &Database{dbUrl: "mock", dbi: d}
+	sqls := make(chan Task, len(tasks)+1)
+	for _, task := range tasks {
+		sqls <- task
+	}
+	sqls <- Task{SQL: stats.POISON_PILL}
+	statsChan := make(chan stats.OneStatement, 100)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	db.RunSQLs(cc, "thread-0", statsChan, &wg, sqls)
+	close(statsChan)
+
+	var sent []stats.OneStatement
+	for st := range statsChan {
+		sent = append(sent, st)
+	}
+	return sent
+}
+
+func Test_reconnect(t *testing.T) {
+	tasks := []Task{{SQLID: "q", SQL: "SELECT 1"}, {SQLID: "q", SQL: "SELECT 2"}, {SQLID: "q", SQL: "SELECT 3"}}
+
+	d := &mockDatabase{sqlite: newSQLite()}
+	sent := runSQLs(t, d, 2, tasks)
+	// a connection for the first two SQLs, a new one for the third
+	want := []string{"CONNECT", "SELECT 1", "SELECT 2", "CONNECT", "SELECT 3"}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d stats, want %d: %v", len(sent), len(want), sent)
+	}
+	for i, st := range sent {
+		if st.SQL != want[i] || st.Err != nil {
+			t.Errorf("stats %d = %s, %v, want %s", i, st.SQL, st.Err, want[i])
+		}
+		if st.SQL == "CONNECT" && st.ID != "connect-for-sqlq" {
+			t.Errorf("connect stats ID = %s, want connect-for-sqlq", st.ID)
+		}
+	}
+	if len(d.sessions) != 2 {
+		t.Fatalf("dialed %d connections, want 2", len(d.sessions))
+	}
+	if got := d.sessions[0].sqls; len(got) != 2 || got[1] != "SELECT 2" {
+		t.Errorf("first connection ran %q", got)
+	}
+	for i, s := range d.sessions {
+		if !s.released {
+			t.Errorf("connection %d is not closed", i)
+		}
+	}
+
+	// the failed connect fails its SQL, the next SQL connects again
+	refused := errors.New("connection refused")
+	d = &mockDatabase{sqlite: newSQLite(), dialErr: func(n int) error {
+		if n == 0 {
+			return refused
+		}
+		return nil
+	}}
+	sent = runSQLs(t, d, 2, tasks[:2])
+	if len(sent) != 4 {
+		t.Fatalf("sent %d stats, want 4: %v", len(sent), sent)
+	}
+	if !errors.Is(sent[0].Err, refused) || !errors.Is(sent[1].Err, refused) {
+		t.Errorf("the failed connect and its SQL report %v, %v, want %v", sent[0].Err, sent[1].Err, refused)
+	}
+	if sent[2].SQL != "CONNECT" || sent[2].Err != nil || sent[3].SQL != "SELECT 2" || sent[3].Err != nil {
+		t.Errorf("after the failed connect sent %v", sent[2:])
+	}
+}
+
+func Test_stmtCacheEvict(t *testing.T) {
+	cc := cli.NewContext(cli.NewApp(), flag.NewFlagSet("", flag.ContinueOnError), nil)
+	cc.Context = context.Background()
+	stmts := newStmtCache(2)
+	conn, err := openSQLX(cc, "sqlite3", filepath.Join(t.TempDir(), "cache.db"), PoolOptions{MaxConns: 1, StmtCache: 2}, stmts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := acquireSQLX(cc, conn, stmts, sqliteOutcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"SELECT ?", "SELECT ? + 1", "SELECT ? + 2", "SELECT ? + 2"} {
+		if err := s.execPrepared(cc, q, []any{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.release()
+	if len(stmts.conns) != 1 {
+		t.Fatalf("the cache has %d connections, want 1", len(stmts.conns))
+	}
+	for _, cs := range stmts.conns {
+		if len(cs.order) != 2 || cs.order[0] != "SELECT ? + 1" {
+			t.Errorf("the cache keeps %q, want the 2 latest statements", cs.order)
+		}
+	}
+
+	// database/sql closes the idle connection, its statements go with it
+	conn.SetMaxIdleConns(0)
+	if len(stmts.conns) != 0 {
+		t.Errorf("the cache keeps %d closed connections", len(stmts.conns))
+	}
+}
+
+func Test_retryable(t *testing.T) {
+	tests := []struct {
+		name string
+		dbi  database
+		err  error
+		want bool
+	}{
+		{"pg serialization failure", newPg(), &pgconn.PgError{Code: "40001"}, true},
+		{"pg deadlock", newPg(), fmt.Errorf("step 2: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"pg unique violation", newPg(), &pgconn.PgError{Code: "23505"}, false},
+		{"mysql deadlock", newMYSQL(), &mysql.MySQLError{Number: erLockDeadlock}, true},
+		{"mysql lock wait timeout", newMYSQL(), &mysql.MySQLError{Number: erLockWaitTimeout}, true},
+		{"mysql duplicate entry", newMYSQL(), &mysql.MySQLError{Number: 1062}, false},
+		{"sqlite busy", newSQLite(), sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{"sqlite locked", newSQLite(), sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{"sqlite constraint", newSQLite(), sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{"other", newPg(), errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dbi.retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runTransaction(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	broken := errors.New("syntax error")
+	// failCommits fails the first n commits with err
+	failCommits := func(n int, err error) func(string) error {
+		return func(sql string) error {
+			if sql == "COMMIT" && n > 0 {
+				n--
+				return err
+			}
+			return nil
+		}
+	}
+	tests := []struct {
+		name        string
+		fail        func(sql string) error
+		wantOutcome string
+		wantErr     error
+		wantAborts  int // of the whole transaction, the attempts run again
+		wantCommits int
+	}{
+		{"committed", nil, "", nil, 0, 1},
+		{"retried", failCommits(2, busy), OutcomeRetried, nil, 2, 3},
+		// the last attempt is the error of the transaction, not an abort
+		{"aborted", failCommits(5, busy), "", busy, 2, 3},
+		{"not retryable", failCommits(1, broken), "", broken, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &Database{dbi: newSQLite()}
+			s := &mockSession{fail: tt.fail}
+			task := Task{SQLID: "tx", Steps: []Step{{SQL: "UPDATE t SET b = 1"}}, Retries: 2}
+			statsChan := make(chan stats.OneStatement, 100)
+			cc := cli.NewContext(cli.NewApp(), flag.NewFlagSet("", flag.ContinueOnError), nil)
+			cc.Context = context.Background()
+
+			outcome, err := db.runTransaction(cc, "thread-0", s, task, statsChan)
+			if outcome != tt.wantOutcome || !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("runTransaction() = %q, %v, want %q, %v", outcome, err, tt.wantOutcome, tt.wantErr)
+			}
+			close(statsChan)
+			aborts := 0
+			for st := range statsChan {
+				if st.ID == "tx" {
+					if !st.Aborted {
+						t.Errorf("runTransaction() reported the transaction as %+v, the caller does", st)
+					}
+					aborts++
+				}
+			}
+			if aborts != tt.wantAborts {
+				t.Errorf("%d aborts reported, want %d", aborts, tt.wantAborts)
+			}
+			if commits := strings.Count(strings.Join(s.sqls, ";"), "COMMIT"); commits != tt.wantCommits {
+				t.Errorf("%d attempts committed, want %d: %q", commits, tt.wantCommits, s.sqls)
+			}
+		})
+	}
+}
+
+func Test_SeedTableFailure(t *testing.T) {
+	failed := errors.New("commit failed")
+	tests := []struct {
+		name        string
+		commitEvery int
+		fail        func(sql string) error
+		wantSQLs    []string // of the last session
+		wantFailed  string   // the ID of the failure reported to stats
+	}{
+		// the failed commit ended the transaction, it is not rolled back
+		{"commit", 2, func(sql string) error {
+			if sql == "COMMIT" {
+				return failed
+			}
+			return nil
+		}, []string{"BEGIN", "INSERT INTO t (a) VALUES (?)", "INSERT INTO t (a) VALUES (?)", "COMMIT"}, "commit-in-tablet"},
+		{"insert in a transaction", 2, func(sql string) error {
+			if sql != "BEGIN" {
+				return failed
+			}
+			return nil
+		}, []string{"BEGIN", "INSERT INTO t (a) VALUES (?)", "ROLLBACK"}, "insert-in-tablet"},
+		{"insert", 0, func(sql string) error { return failed }, []string{"INSERT INTO t (a) VALUES (?)"}, "insert-in-tablet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &mockDatabase{sqlite: newSQLite(), fail: tt.fail}
+			db := &Database{dbUrl: "mock", dbi: d, opened: true}
+			cc := cli.NewContext(cli.NewApp(), flag.NewFlagSet("", flag.ContinueOnError), nil)
+			cc.Context = context.Background()
+			n := 0
+			rows := func() ([]any, bool) {
+				n++
+				return []any{n}, n <= 10
+			}
+			var progress []int
+			opts := InsertOptions{CommitEvery: tt.commitEvery, Progress: func(rows int) { progress = append(progress, rows) }}
+			statsChan := make(chan stats.OneStatement, 100)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			db.SeedTable(cc, "thread-0", "t", []string{"a"}, rows, opts, statsChan, &wg)
+			close(statsChan)
+
+			if len(progress) > 0 {
+				t.Errorf("progress %v of a thread that committed nothing", progress)
+			}
+			s := d.sessions[len(d.sessions)-1]
+			if !reflect.DeepEqual(s.sqls, tt.wantSQLs) || !s.released {
+				t.Errorf("ran %q, released %v, want %q", s.sqls, s.released, tt.wantSQLs)
+			}
+			var last stats.OneStatement
+			for st := range statsChan {
+				last = st
+			}
+			if last.ID != tt.wantFailed || !errors.Is(last.Err, failed) {
+				t.Errorf("reported %s %v, want %s %v", last.ID, last.Err, tt.wantFailed, failed)
+			}
+		})
+	}
+
+	// the sessions of the drivers roll back nothing once the transaction is over
+	if err := (&sqlxSession{}).rollback(nil); err != nil {
+		t.Errorf("sqlx rollback without a transaction = %v", err)
+	}
+	if err := (&pgSession{}).rollback(nil); err != nil {
+		t.Errorf("pg rollback without a transaction = %v", err)
+	}
+}
+
+func Test_transactionTimeout(t *testing.T) {
+	// the step runs out of the timeout of the transaction, like a single SQL it is a timeout, not an error
+	d := &mockDatabase{sqlite: newSQLite(), fail: func(sql string) error {
+		if sql == "SELECT pg_sleep(10)" {
+			return fmt.Errorf("step: %w", context.DeadlineExceeded)
+		}
+		return nil
+	}}
+	task := Task{SQLID: "tx", Steps: []Step{{SQL: "SELECT 1"}, {SQL: "SELECT pg_sleep(10)"}}, Timeout: time.Minute}
+	sent := runSQLs(t, d, 1, []Task{task})
+
+	timeouts := map[string]bool{}
+	for _, st := range sent {
+		if st.Err != nil {
+			timeouts[st.ID] = st.Timeout && !st.Aborted
+		}
+	}
+	want := map[string]bool{"tx-step2": true, "tx": true}
+	if !reflect.DeepEqual(timeouts, want) {
+		t.Errorf("failed stats %v, want the step and the transaction timed out %v", timeouts, want)
+	}
+}
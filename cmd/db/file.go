@@ -0,0 +1,320 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSink writes the generated rows to files instead of inserting them into a database,
+// one file per table in the out dir, so the data generated once can be loaded many times with the native tools.
+// It stands in for Database in the seed command, the insert threads of a table share its file.
+type FileSink struct {
+	dir    string
+	format string // csv, jsonl, sql (INSERT statements) or copy (Postgres COPY)
+	dbType string
+	gzip   bool
+	dbi    database // to render the SQL of the sql and copy formats
+
+	mu    sync.Mutex
+	files map[string]*sinkFile
+}
+
+type sinkFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	csv    *csv.Writer
+	fields []string
+	inCopy bool // COPY ... FROM stdin is open and must be ended before any other SQL
+}
+
+func NewFileSink(dir string, format string, dbType string, gz bool) (*FileSink, error) {
+	s := &FileSink{
+		dir:    dir,
+		format: format,
+		dbType: dbType,
+		gzip:   gz,
+		files:  make(map[string]*sinkFile),
+	}
+	switch format {
+	case "csv", "jsonl":
+		// only to quote the literals of the stress SQLs
+		s.dbi = New(dbType, "").dbi
+	case "copy":
+		if dbType != "postgres" {
+			return nil, fmt.Errorf("COPY dump is for postgres only, not %s", dbType)
+		}
+		s.dbi = New(dbType, "").dbi
+	case "sql":
+		if s.dbi = New(dbType, "").dbi; s.dbi == nil {
+			return nil, fmt.Errorf("unknown db type %s for the SQL dump", dbType)
+		}
+	default:
+		return nil, fmt.Errorf("unknown output format %s: csv, jsonl, sql or copy", format)
+	}
+	return s, nil
+}
+
+func (s *FileSink) fileName(table string) string {
+	ext := s.format
+	if s.format == "copy" {
+		ext = "sql"
+	}
+	name := filepath.Join(s.dir, table+"."+ext)
+	if s.gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// file returns the file of the table, creating it on the first call
+func (s *FileSink) file(table string, fields []string) (*sinkFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sf, ok := s.files[table]; ok {
+		if sf.fields == nil {
+			sf.fields = fields
+		}
+		return sf, nil
+	}
+
+	name := s.fileName(table)
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("writing table to file", "table", table, "file", name)
+	sf := &sinkFile{f: f, fields: fields}
+	var w io.Writer = f
+	if s.gzip {
+		sf.gz = gzip.NewWriter(f)
+		w = sf.gz
+	}
+	sf.w = bufio.NewWriterSize(w, 1<<20)
+	if s.format == "csv" {
+		sf.csv = csv.NewWriter(sf.w)
+		// the header goes first, whichever thread comes first
+		if err := sf.csv.Write(fields); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s.files[table] = sf
+	return sf, nil
+}
+
+// writeSQL appends statements to the sql and copy dumps, the other formats have no place for them
+func (s *FileSink) writeSQL(table string, sqls ...string) error {
+	if s.format != "sql" && s.format != "copy" {
+		return nil
+	}
+	sf, err := s.file(table, nil)
+	if err != nil {
+		return err
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.inCopy {
+		sf.w.WriteString("\\.\n")
+		sf.inCopy = false
+	}
+	for _, sql := range sqls {
+		if _, err := sf.w.WriteString(sql + ";\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) writeRow(table string, sf *sinkFile, vals []any, conflict Conflict) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	switch s.format {
+	case "csv":
+		rec := make([]string, len(vals))
+		for i, v := range vals {
+			if v != nil {
+				rec[i] = fmt.Sprint(v)
+			}
+		}
+		return sf.csv.Write(rec)
+	case "jsonl":
+		m := make(map[string]any, len(vals))
+		for i, v := range vals {
+			m[sf.fields[i]] = v
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		sf.w.Write(b)
+		return sf.w.WriteByte('\n')
+	case "sql":
+		lits := make([]string, len(vals))
+		for i, v := range vals {
+			lits[i] = sqlLiteral(s.dbi, v)
+		}
+		_, err := sf.w.WriteString(s.dbi.buildInsert(table, sf.fields, lits, conflict) + ";\n")
+		return err
+	default: // copy
+		if !sf.inCopy {
+			sf.w.WriteString("COPY " + table + " (" + strings.Join(sf.fields, ",") + ") FROM stdin;\n")
+			sf.inCopy = true
+		}
+		cols := make([]string, len(vals))
+		for i, v := range vals {
+			cols[i] = copyValue(v)
+		}
+		_, err := sf.w.WriteString(strings.Join(cols, "\t") + "\n")
+		return err
+	}
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// copyValue renders a value in the text format of COPY
+func copyValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return `\N`
+	case int:
+		return strconv.Itoa(v)
+	default:
+		return copyEscaper.Replace(fmt.Sprint(v))
+	}
+}
+
+func (s *FileSink) SeedTable(cc *cli.Context,
+	threadID string,
+	table string,
+	fields []string,
+	rows RowSource,
+	opts InsertOptions,
+	statsChan chan stats.OneStatement,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	sf, err := s.file(table, fields)
+	if err != nil {
+		log.Fatalf("failed to create the file of table %s: %v", table, err)
+	}
+
+	count := 0
+	for {
+		if cc.Context.Err() != nil {
+			slog.Warn("writing interrupted", "table", table, "thread", threadID, "written", count)
+			return
+		}
+		vals, ok := rows()
+		if !ok {
+			return
+		}
+
+		// only the interruption stops the wait
+		if err := opts.wait(cc.Context); err != nil {
+			continue
+		}
+
+		start := time.Now()
+		if err := s.writeRow(table, sf, vals, opts.Conflict); err != nil {
+			log.Fatalf("failed to write a row of %s to %s: %v", table, s.fileName(table), err)
+		}
+
+		count++
+		if count%10000 == 0 {
+			slog.Info("rows written", "table", table, "thread", threadID, "count", count)
+		}
+		if opts.Progress != nil {
+			opts.Progress(count)
+		}
+
+		statsChan <- stats.OneStatement{
+			ID:         "insert-in-table" + table,
+			ThreadID:   threadID,
+			SQL:        fmt.Sprint(vals...),
+			Duration:   time.Since(start),
+			TargetRate: opts.TargetRate,
+		}
+	}
+}
+
+func (s *FileSink) RenderSQLSelect(sqlStatement string,
+	jsonStrings []string,
+	tokens []string) (string, error) {
+	return renderSQLSelect(sqlStatement, jsonStrings, tokens), nil
+}
+
+// Literal renders a value as an SQL literal of the db type of the sink
+func (s *FileSink) Literal(v any) string {
+	return sqlLiteral(s.dbi, v)
+}
+
+// BindVar is the placeholder of the i-th, 0 based, bind variable of the db type of the sink, ? if there is none
+func (s *FileSink) BindVar(i int) string {
+	if s.dbi == nil {
+		return "?"
+	}
+	return s.dbi.bindVar(i)
+}
+
+// PrepareTable puts the DDL the options call for at the head of the SQL dumps
+func (s *FileSink) PrepareTable(cc *cli.Context, table string, schema *TableSchema, opts SchemaOptions) error {
+	if s.dbi == nil {
+		return nil
+	}
+	return s.writeSQL(table, schemaSQLs(s.dbi, table, schema, opts)...)
+}
+
+// CreateIndexes puts the index DDL after the rows of the SQL dumps, the way seed builds them
+func (s *FileSink) CreateIndexes(cc *cli.Context, table string, schema *TableSchema, statsChan chan stats.OneStatement) error {
+	var sqls []string
+	for _, index := range schema.Indexes {
+		sqls = append(sqls, buildCreateIndex(table, index.name(table), index, s.dbType != "mysql"))
+	}
+	return s.writeSQL(table, sqls...)
+}
+
+// Close flushes and closes the table files
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ret error
+	for table, sf := range s.files {
+		if sf.inCopy {
+			sf.w.WriteString("\\.\n")
+		}
+		if sf.csv != nil {
+			sf.csv.Flush()
+		}
+		err := sf.w.Flush()
+		if sf.gz != nil && err == nil {
+			err = sf.gz.Close()
+		}
+		if err == nil {
+			err = sf.f.Close()
+		}
+		if err != nil {
+			ret = fmt.Errorf("failed to write the file of table %s: %w", table, err)
+		}
+	}
+	return ret
+}
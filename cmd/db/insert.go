@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// what an insert does when the row violates a unique constraint
+const (
+	ConflictError  = "error"  // fail, the default
+	ConflictIgnore = "ignore" // skip the row
+	ConflictUpdate = "update" // overwrite the existing row with the new values
+)
+
+// what became of an inserted row, counted in the stats
+const (
+	OutcomeInserted = "inserted"
+	OutcomeSkipped  = "skipped"
+	OutcomeUpdated  = "updated"
+	// SQLite INSERT OR REPLACE does not tell a replaced row from a new one
+	OutcomeUpserted = "inserted or replaced"
+)
+
+// Conflict is the onConflict mode of a table and the columns of the unique key the conflicts are resolved on.
+// Postgres needs the key to update, the other dialects resolve the conflicts on any unique key.
+type Conflict struct {
+	Mode string
+	Keys []string
+}
+
+func (c Conflict) Validate(dbType string) error {
+	switch c.Mode {
+	case "", ConflictError, ConflictIgnore:
+	case ConflictUpdate:
+		if dbType == "postgres" && len(c.Keys) == 0 {
+			return fmt.Errorf("onConflict update needs the conflict key: the schema primaryKey or a single unique field")
+		}
+	default:
+		return fmt.Errorf("unknown onConflict mode %s: error, ignore or update", c.Mode)
+	}
+	return nil
+}
+
+// updated returns the fields an update on conflict overwrites: all but the key ones.
+// If all of them are the key, the first one is set to itself to keep the statement valid.
+func (c Conflict) updated(fields []string) []string {
+	key := make(map[string]bool, len(c.Keys))
+	for _, k := range c.Keys {
+		key[k] = true
+	}
+	var ret []string
+	for _, f := range fields {
+		if !key[f] {
+			ret = append(ret, f)
+		}
+	}
+	if len(ret) == 0 {
+		return fields[:1]
+	}
+	return ret
+}
+
+// InsertOptions tell SeedTable how to insert the rows of a table
+type InsertOptions struct {
+	CommitEvery int // inserts per transaction, 0 for autocommit
+	Conflict    Conflict
+	// called with the rows the thread has committed so far, after each commit
+	Progress func(rows int)
+	// each insert takes a token from every bucket: the one shared by the table threads and the one of the thread
+	Limiters []*TokenBucket
+	// the rows per second the limiters allow the table, reported next to the observed rate
+	TargetRate float64
+}
+
+// wait takes a token from each limiter
+func (o *InsertOptions) wait(ctx context.Context) error {
+	for _, l := range o.Limiters {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertInto builds the dialect neutral part of an insert, values are the bind variables or the literals
+func insertInto(verb string, table string, fields []string, values []string) string {
+	return verb + " INTO " + table + " (" + strings.Join(fields, ",") + ") VALUES (" + strings.Join(values, ",") + ")"
+}
+
+func bindVars(dbi database, n int) []string {
+	vars := make([]string, n)
+	for i := range vars {
+		vars[i] = dbi.bindVar(i)
+	}
+	return vars
+}
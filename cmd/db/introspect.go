@@ -0,0 +1,126 @@
+package db
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"strconv"
+)
+
+// TableInfo is what the init command learns about an existing table
+type TableInfo struct {
+	Table   string
+	Columns []ColumnInfo
+	Indexes []Index
+}
+
+type ColumnInfo struct {
+	Name       string
+	Type       string // as the database spells it: varchar(255), int unsigned, ...
+	MaxLength  int    // max length of the character types, 0 otherwise
+	NotNull    bool
+	PrimaryKey bool
+	Unique     bool // single column unique constraint or index
+	References *ForeignKey
+}
+
+type ForeignKey struct {
+	Table  string
+	Column string
+}
+
+func (t *TableInfo) column(name string) *ColumnInfo {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+// DescribeTable reads the columns, constraints and indexes of an existing table
+func (db *Database) DescribeTable(cc *cli.Context, table string) (*TableInfo, error) {
+	var info *TableInfo
+	err := db.withSession(cc, func(s session) error {
+		var err error
+		info, err = db.dbi.describeTable(cc, s, table)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %w", table, err)
+	}
+	if len(info.Columns) == 0 {
+		return nil, fmt.Errorf("table %s not found", table)
+	}
+	return info, nil
+}
+
+// the drivers return strings as []byte or string and integers as any of the int types
+func asString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func asFloat(v any) float64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	default:
+		f, _ := strconv.ParseFloat(asString(v), 64)
+		return f
+	}
+}
+
+func asInt(v any) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	default:
+		i, _ := strconv.Atoi(asString(v))
+		return i
+	}
+}
+
+// addIndexColumn collects the (index, column) rows the catalog queries return, in the column order
+func (t *TableInfo) addIndexColumn(name string, unique bool, column string) {
+	for i := range t.Indexes {
+		if t.Indexes[i].Name == name {
+			t.Indexes[i].Columns = append(t.Indexes[i].Columns, column)
+			return
+		}
+	}
+	t.Indexes = append(t.Indexes, Index{Name: name, Columns: []string{column}, Unique: unique})
+}
+
+// markUnique flags the columns that have a single column unique index of their own
+func (t *TableInfo) markUnique() {
+	for _, index := range t.Indexes {
+		if !index.Unique || len(index.Columns) != 1 {
+			continue
+		}
+		if c := t.column(index.Columns[0]); c != nil {
+			c.Unique = true
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// PoolOptions size the connection pool the threads of a run share
+type PoolOptions struct {
+	MaxConns    int
+	MinConns    int
+	IdleTimeout time.Duration // 0 keeps the idle connections
+	MaxLifetime time.Duration // 0 keeps the connections forever
+	SessionInit []string      // run on each new connection, like SET work_mem = '64MB'
+	StmtCache   int           // prepared statements kept per connection, 0 prepares each statement anew
+}
+
+// PoolOptionsFromFlags reads the pool flags. max-conns defaults to the most threads the run has at once,
+// so no thread waits for a connection unless asked to.
+func PoolOptionsFromFlags(cc *cli.Context, threads int) PoolOptions {
+	opts := PoolOptions{
+		MaxConns:    cc.Int("max-conns"),
+		MinConns:    cc.Int("min-conns"),
+		IdleTimeout: cc.Duration("conn-idle-timeout"),
+		MaxLifetime: cc.Duration("conn-max-lifetime"),
+		SessionInit: cc.StringSlice("session-init"),
+		StmtCache:   cc.Int("stmt-cache"),
+	}
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = max(threads, 1)
+	}
+	opts.MinConns = min(opts.MinConns, opts.MaxConns)
+	return opts
+}
+
+func (db *Database) SetPoolOptions(opts PoolOptions) {
+	db.poolOpts = opts
+}
+
+// SetSessionInit sets the statements each new connection runs.
+// The connections of an open pool have run the previous ones, so the pool is closed to be opened anew.
+func (db *Database) SetSessionInit(cc *cli.Context, sessionInit []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if slices.Equal(db.poolOpts.SessionInit, sessionInit) {
+		return nil
+	}
+	db.poolOpts.SessionInit = sessionInit
+	if !db.opened {
+		return nil
+	}
+	db.opened = false
+	return db.dbi.close(cc)
+}
+
+// open connects the pool on the first use
+func (db *Database) open(cc *cli.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.opened {
+		return nil
+	}
+	slog.Info("opening connection pool", "db", db.dbType, "maxConns", db.poolOpts.MaxConns, "minConns", db.poolOpts.MinConns,
+		"idleTimeout", db.poolOpts.IdleTimeout, "maxLifetime", db.poolOpts.MaxLifetime, "sessionInit", db.poolOpts.SessionInit,
+		"stmtCache", db.poolOpts.StmtCache)
+	if err := db.dbi.connect(cc, db.poolOpts); err != nil {
+		return fmt.Errorf("failed to connect to db %s error %w", db.dbUrl, err)
+	}
+	db.opened = true
+	return nil
+}
+
+// Close closes the pool, if it was opened
+func (db *Database) Close(cc *cli.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.opened {
+		return nil
+	}
+	db.opened = false
+	return db.dbi.close(cc)
+}
+
+// acquire checks a connection out of the pool, wait is how long it took
+func (db *Database) acquire(cc *cli.Context) (s session, wait time.Duration, err error) {
+	if err := db.open(cc); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	s, err = db.dbi.acquire(cc)
+	return s, time.Since(start), err
+}
+
+// withSession runs f on a connection of the pool
+func (db *Database) withSession(cc *cli.Context, f func(s session) error) error {
+	s, _, err := db.acquire(cc)
+	if err != nil {
+		return err
+	}
+	defer s.release()
+	return f(s)
+}
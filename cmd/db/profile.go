@@ -0,0 +1,156 @@
+package db
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+)
+
+// TableProfile is what the profile command learns about the data of an existing table
+type TableProfile struct {
+	Table   string
+	Rows    int
+	Columns map[string]*ColumnProfile
+}
+
+type ColumnProfile struct {
+	Sampled  int // rows looked at
+	NonNull  int
+	Distinct int
+	Min      int // the value for the numbers
+	Max      int
+	MinLen   int // the length for the strings
+	MaxLen   int
+	AvgLen   float64
+	Lengths  []ValueCount // length -> rows, ascending by length
+	Top      []ValueCount // most frequent values, descending by count
+}
+
+type ValueCount struct {
+	Value any // int or string
+	Count int
+}
+
+// ProfileTable samples the first sample rows of the table (all of them if sample is 0)
+// and collects the value stats of the given columns plus the topN most frequent values of each.
+// columns maps the column name to true for the character columns and to false for the integer ones.
+func (db *Database) ProfileTable(cc *cli.Context, table string, columns map[string]bool, sample int, topN int) (*TableProfile, error) {
+	s, _, err := db.acquire(cc)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	p := &TableProfile{Table: table, Columns: make(map[string]*ColumnProfile, len(columns))}
+	rows, err := s.query(cc, "SELECT count(1) FROM "+table, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.Rows = asInt(rows[0][0])
+
+	for c, isString := range columns {
+		from := table
+		if sample > 0 {
+			from = fmt.Sprintf("(SELECT %s FROM %s LIMIT %d) s", c, table, sample)
+		}
+		length := "0"
+		if isString {
+			length = db.dbi.buildLength(c)
+		}
+
+		rows, err := s.query(cc, fmt.Sprintf(
+			"SELECT count(1), count(%[1]s), count(DISTINCT %[1]s), min(%[1]s), max(%[1]s), min(%[2]s), max(%[2]s), avg(%[2]s) FROM %[3]s",
+			c, length, from), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to profile %s.%s: %w", table, c, err)
+		}
+		r := rows[0]
+		cp := &ColumnProfile{
+			Sampled:  asInt(r[0]),
+			NonNull:  asInt(r[1]),
+			Distinct: asInt(r[2]),
+			Min:      asInt(r[3]),
+			Max:      asInt(r[4]),
+			MinLen:   asInt(r[5]),
+			MaxLen:   asInt(r[6]),
+			AvgLen:   asFloat(r[7]),
+		}
+
+		rows, err = s.query(cc, fmt.Sprintf(
+			"SELECT %[1]s, count(1) FROM %[2]s WHERE %[1]s IS NOT NULL GROUP BY %[1]s ORDER BY 2 DESC LIMIT %[3]d",
+			c, from, topN), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the top values of %s.%s: %w", table, c, err)
+		}
+		for _, r := range rows {
+			var v any = asInt(r[0])
+			if isString {
+				v = asString(r[0])
+			}
+			cp.Top = append(cp.Top, ValueCount{Value: v, Count: asInt(r[1])})
+		}
+
+		if !isString {
+			p.Columns[c] = cp
+			continue
+		}
+
+		rows, err = s.query(cc, fmt.Sprintf(
+			"SELECT %[1]s, count(1) FROM %[2]s WHERE %[3]s IS NOT NULL GROUP BY %[1]s ORDER BY 1",
+			length, from, c), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the lengths of %s.%s: %w", table, c, err)
+		}
+		for _, r := range rows {
+			cp.Lengths = append(cp.Lengths, ValueCount{Value: asInt(r[0]), Count: asInt(r[1])})
+		}
+
+		p.Columns[c] = cp
+	}
+	return p, nil
+}
+
+// LengthQuantile returns the length that the q (0..1) share of the profiled values does not exceed
+func (c *ColumnProfile) LengthQuantile(q float64) int {
+	total := 0
+	for _, l := range c.Lengths {
+		total += l.Count
+	}
+	seen := 0
+	for _, l := range c.Lengths {
+		seen += l.Count
+		if float64(seen) >= q*float64(total) {
+			return l.Value.(int)
+		}
+	}
+	return c.MaxLen
+}
+
+// SampleValues returns the distinct non NULL values of the column with the rows of each
+// of the first sample rows of the table (all of them if sample is 0)
+func (db *Database) SampleValues(cc *cli.Context, table string, column string, isString bool, sample int) ([]ValueCount, error) {
+	s, _, err := db.acquire(cc)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	from := table
+	if sample > 0 {
+		from = fmt.Sprintf("(SELECT %s FROM %s LIMIT %d) s", column, table, sample)
+	}
+	rows, err := s.query(cc, fmt.Sprintf(
+		"SELECT %[1]s, count(1) FROM %[2]s WHERE %[1]s IS NOT NULL GROUP BY %[1]s ORDER BY 1",
+		column, from), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample %s.%s: %w", table, column, err)
+	}
+	values := make([]ValueCount, len(rows))
+	for i, r := range rows {
+		var v any = asInt(r[0])
+		if isString {
+			v = asString(r[0])
+		}
+		values[i] = ValueCount{Value: v, Count: asInt(r[1])}
+	}
+	return values, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the rate of the inserts. A bucket can be shared by the threads of a table
+// to cap their total rate, or owned by a thread to cap its own.
+// It holds up to a tenth of a second of tokens, so a paused thread does not burst far above the rate.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := max(1, rate/10)
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait takes a token, sleeping until there is one. The tokens may go negative:
+// the waiting callers queue up by reserving the future tokens.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token at now and returns how long to wait for it
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// TableSchema is the optional "schema" section of a table seed config.
+// Seed uses it to create the table when run with --create-schema or --drop-existing.
+type TableSchema struct {
+	Columns    []Column `json:"columns"`
+	PrimaryKey []string `json:"primaryKey,omitempty"`
+	Indexes    []Index  `json:"indexes,omitempty"`
+}
+
+type Column struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // as the target database spells it: INTEGER, VARCHAR(255), TEXT...
+	NotNull bool   `json:"notNull"`
+}
+
+type Index struct {
+	Name    string   `json:"name"` // <table>_<columns>_idx if not given
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+// SchemaOptions tell what to do with a table before seeding it
+type SchemaOptions struct {
+	Create       bool // create the table if it does not exist and its indexes after it is loaded
+	DropExisting bool // drop the table and create it anew
+	Truncate     bool // remove the rows the table already has
+}
+
+func (o SchemaOptions) CreatesTables() bool {
+	return o.Create || o.DropExisting
+}
+
+func (i Index) name(table string) string {
+	if len(i.Name) > 0 {
+		return i.Name
+	}
+	return table + "_" + strings.Join(i.Columns, "_") + "_idx"
+}
+
+func buildCreateTable(table string, schema *TableSchema) string {
+	defs := make([]string, 0, len(schema.Columns)+1)
+	for _, c := range schema.Columns {
+		def := c.Name + " " + c.Type
+		if c.NotNull {
+			def += " NOT NULL"
+		}
+		defs = append(defs, def)
+	}
+	if len(schema.PrimaryKey) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(schema.PrimaryKey, ",")+")")
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " (" + strings.Join(defs, ", ") + ")"
+}
+
+func buildCreateIndex(table string, name string, index Index, ifNotExists bool) string {
+	sql := "CREATE "
+	if index.Unique {
+		sql += "UNIQUE "
+	}
+	sql += "INDEX "
+	if ifNotExists {
+		sql += "IF NOT EXISTS "
+	}
+	return sql + name + " ON " + table + " (" + strings.Join(index.Columns, ",") + ")"
+}
+
+func buildDropTable(table string) string {
+	return "DROP TABLE IF EXISTS " + table
+}
+
+// schemaSQLs returns the statements preparing the table per the options
+func schemaSQLs(dbi database, table string, schema *TableSchema, opts SchemaOptions) []string {
+	var sqls []string
+	if opts.DropExisting {
+		sqls = append(sqls, buildDropTable(table))
+	}
+	if opts.CreatesTables() {
+		sqls = append(sqls, buildCreateTable(table, schema))
+	}
+	// a table we have just dropped is empty anyway
+	if opts.Truncate && !opts.DropExisting {
+		sqls = append(sqls, dbi.buildTruncate(table))
+	}
+	return sqls
+}
+
+// PrepareTable drops, creates or truncates the table per the options before it is seeded.
+// The indexes are created after the table is loaded by CreateIndexes.
+func (db *Database) PrepareTable(cc *cli.Context, table string, schema *TableSchema, opts SchemaOptions) error {
+	return db.withSession(cc, func(s session) error {
+		for _, sql := range schemaSQLs(db.dbi, table, schema, opts) {
+			slog.Info("preparing schema", "table", table, "sql", sql)
+			if err := s.execLiteral(cc, sql); err != nil {
+				return fmt.Errorf("failed to run %s: %w", sql, err)
+			}
+		}
+		return nil
+	})
+}
+
+// CreateIndexes builds the indexes of the loaded table. Each build time goes to stats
+// under its own create-index ID, so it is not mixed with the inserts.
+func (db *Database) CreateIndexes(cc *cli.Context, table string, schema *TableSchema, statsChan chan stats.OneStatement) error {
+	if len(schema.Indexes) == 0 {
+		return nil
+	}
+
+	return db.withSession(cc, func(s session) error {
+		for _, index := range schema.Indexes {
+			name := index.name(table)
+			slog.Info("creating index", "table", table, "index", name)
+			start := time.Now()
+			if err := db.dbi.createIndex(cc, s, table, name, index); err != nil {
+				return fmt.Errorf("failed to create index %s on %s: %w", name, table, err)
+			}
+			statsChan <- stats.OneStatement{
+				ID:       "create-index-in-table" + table,
+				ThreadID: "thread-0",
+				SQL:      name + " (" + strings.Join(index.Columns, ",") + ")",
+				Duration: time.Since(start),
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,450 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/urfave/cli/v2"
+	"sync"
+)
+
+// session is a connection checked out of the pool shared by the threads of the run.
+// A thread holds it for one unit of work, a statement or a transaction, and releases it back to the pool.
+type session interface {
+	exec(cc *cli.Context, sql string, arguments []any) error
+	insert(cc *cli.Context, sql string, arguments []any, conflictMode string) (outcome string, err error)
+	execLiteral(cc *cli.Context, sql string) error
+	execPrepared(cc *cli.Context, sql string, arguments []any) error // prepared, from the statement cache if there is one
+	query(cc *cli.Context, sql string, arguments []any) ([][]any, error)
+	begin(cc *cli.Context) error // the statements go to the transaction until commit or rollback
+	commit(cc *cli.Context) error
+	rollback(cc *cli.Context) error
+	release()
+}
+
+// sqlxSession is the session of the database/sql drivers: MySQL and SQLite
+type sqlxSession struct {
+	conn *sqlx.Conn
+	tx   *sqlx.Tx // the open transaction the statements go to, nil in autocommit
+	own  *sqlx.DB // the one connection pool of a dialed session, closed on release
+	// the prepared statements of the connections, nil to prepare each statement anew
+	stmts *stmtCache
+	// tells what became of an inserted row from the result, the drivers report the affected rows differently
+	outcome func(res sql.Result, conflictMode string) (string, error)
+}
+
+// initConnector runs the session init statements on each connection it opens
+// and, with a statement cache, has the connection drop its statements from the cache on close
+type initConnector struct {
+	driver.Connector
+	sessionInit []string
+	stmts       *stmtCache
+}
+
+func (c *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err == nil && c.stmts != nil {
+		conn = &cachedConn{Conn: conn, stmts: c.stmts}
+	}
+	if err != nil || len(c.sessionInit) == 0 {
+		return conn, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("the driver can't run the session init")
+	}
+	for _, q := range c.sessionInit {
+		if _, err := execer.ExecContext(ctx, q, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("session init %s: %w", q, err)
+		}
+	}
+	return conn, nil
+}
+
+// dsnConnector is the connector of the drivers that have none, like sqlite3
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// connectSQLX is sqlx.Connect running the session init on each new connection
+func connectSQLX(cc *cli.Context, driverName string, dsn string, sessionInit []string, stmts *stmtCache) (*sqlx.DB, error) {
+	// sql.Open does not connect, it's here to look the driver up
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+
+	var connector driver.Connector = dsnConnector{dsn: dsn, driver: d}
+	if dc, ok := d.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	conn := sqlx.NewDb(sql.OpenDB(&initConnector{Connector: connector, sessionInit: sessionInit, stmts: stmts}), driverName)
+	if err := conn.PingContext(cc.Context); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// openSQLX opens the database/sql pool sized by the options.
+// The idle connections are kept up to the max, so the threads checking them out per statement reuse them.
+func openSQLX(cc *cli.Context, driver string, dsn string, opts PoolOptions, stmts *stmtCache) (*sqlx.DB, error) {
+	conn, err := connectSQLX(cc, driver, dsn, opts.SessionInit, stmts)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(opts.MaxConns)
+	conn.SetMaxIdleConns(max(opts.MaxConns, opts.MinConns, 2))
+	conn.SetConnMaxIdleTime(opts.IdleTimeout)
+	conn.SetConnMaxLifetime(opts.MaxLifetime)
+
+	// database/sql has no min connections, open them up front
+	conns := make([]*sql.Conn, 0, opts.MinConns)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < opts.MinConns; i++ {
+		c, err := conn.Conn(cc.Context)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conn, nil
+}
+
+func acquireSQLX(cc *cli.Context, conn *sqlx.DB, stmts *stmtCache, outcome func(res sql.Result, conflictMode string) (string, error)) (session, error) {
+	c, err := conn.Connx(cc.Context)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlxSession{conn: c, stmts: stmts, outcome: outcome}, nil
+}
+
+// dialSQLX opens a connection outside the pool, connectSQLX pings the database so the handshake is done
+func dialSQLX(cc *cli.Context, driver string, dsn string, opts PoolOptions, outcome func(res sql.Result, conflictMode string) (string, error)) (session, error) {
+	stmts := newStmtCache(opts.StmtCache)
+	own, err := connectSQLX(cc, driver, dsn, opts.SessionInit, stmts)
+	if err != nil {
+		return nil, err
+	}
+	own.SetMaxOpenConns(1)
+	c, err := own.Connx(cc.Context)
+	if err != nil {
+		own.Close()
+		return nil, err
+	}
+	return &sqlxSession{conn: c, own: own, stmts: stmts, outcome: outcome}, nil
+}
+
+func (s *sqlxSession) execer() sqlx.ExecerContext {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.conn
+}
+
+func (s *sqlxSession) exec(cc *cli.Context, query string, args []any) error {
+	_, err := s.execer().ExecContext(cc.Context, query, args...)
+	return err
+}
+
+func (s *sqlxSession) insert(cc *cli.Context, query string, args []any, mode string) (string, error) {
+	res, err := s.execer().ExecContext(cc.Context, query, args...)
+	if err != nil {
+		return "", err
+	}
+	return s.outcome(res, mode)
+}
+
+func (s *sqlxSession) execLiteral(cc *cli.Context, query string) error {
+	_, err := s.execer().ExecContext(cc.Context, query)
+	return err
+}
+
+// execPrepared prepares the statement on the connection and runs it with the arguments.
+// Without a statement cache, or in a transaction, the statement is closed once run.
+func (s *sqlxSession) execPrepared(cc *cli.Context, query string, args []any) error {
+	if s.stmts == nil || s.tx != nil {
+		var stmt *sqlx.Stmt
+		var err error
+		if s.tx != nil {
+			stmt, err = s.tx.PreparexContext(cc.Context, query)
+		} else {
+			stmt, err = s.conn.PreparexContext(cc.Context, query)
+		}
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		_, err = stmt.ExecContext(cc.Context, args...)
+		return err
+	}
+
+	// the sql.Conn is a wrapper of the checkout, the statements are kept per driver connection
+	return s.conn.Raw(func(dc any) error {
+		stmt, err := s.stmts.get(cc.Context, dc.(driver.Conn), query)
+		if err != nil {
+			return err
+		}
+		return execStmt(cc.Context, stmt, args)
+	})
+}
+
+func (s *sqlxSession) query(cc *cli.Context, query string, args []any) ([][]any, error) {
+	if s.tx != nil {
+		return queryRows(cc, s.tx, query, args)
+	}
+	return queryRows(cc, s.conn, query, args)
+}
+
+func (s *sqlxSession) begin(cc *cli.Context) error {
+	var err error
+	s.tx, err = s.conn.BeginTxx(cc.Context, nil)
+	return err
+}
+
+func (s *sqlxSession) commit(cc *cli.Context) error {
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+// rollback is a no-op once the transaction is over, like after a failed commit
+func (s *sqlxSession) rollback(cc *cli.Context) error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+// release returns the connection to the pool or closes it, rolling back the transaction left open
+func (s *sqlxSession) release() {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+	if s.own != nil {
+		s.stmts.close()
+	}
+	s.conn.Close()
+	if s.own != nil {
+		s.own.Close()
+	}
+}
+
+// queryRows runs a query through database/sql and returns all the rows it produced
+func queryRows(cc *cli.Context, conn sqlx.QueryerContext, query string, args []any) ([][]any, error) {
+	rows, err := conn.QueryxContext(cc.Context, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret [][]any
+	for rows.Next() {
+		vals, err := rows.SliceScan()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, vals)
+	}
+	return ret, rows.Err()
+}
+
+// stmtCache keeps up to capacity prepared statements per driver connection, dropping the oldest ones.
+// database/sql re-prepares a statement on each connection it is run on, but only for the statements
+// of the pool, not of a checked out connection, so the cache is ours.
+type stmtCache struct {
+	mu       sync.Mutex
+	capacity int
+	conns    map[driver.Conn]*connStmts
+}
+
+type connStmts struct {
+	stmts map[string]driver.Stmt
+	order []string // the statements as prepared, the oldest first
+}
+
+// newStmtCache returns nil for no caching
+func newStmtCache(capacity int) *stmtCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &stmtCache{capacity: capacity, conns: make(map[driver.Conn]*connStmts)}
+}
+
+// get returns the statement prepared on the connection, preparing it on the first call.
+// The caller holds the connection, so only the map of the connections needs the lock.
+func (c *stmtCache) get(ctx context.Context, dc driver.Conn, query string) (driver.Stmt, error) {
+	c.mu.Lock()
+	cs, ok := c.conns[dc]
+	if !ok {
+		cs = &connStmts{stmts: make(map[string]driver.Stmt)}
+		c.conns[dc] = cs
+	}
+	c.mu.Unlock()
+
+	if stmt, ok := cs.stmts[query]; ok {
+		return stmt, nil
+	}
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := dc.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = dc.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cs.order) >= c.capacity {
+		cs.stmts[cs.order[0]].Close()
+		delete(cs.stmts, cs.order[0])
+		cs.order = cs.order[1:]
+	}
+	cs.stmts[query] = stmt
+	cs.order = append(cs.order, query)
+	return stmt, nil
+}
+
+// evict closes the statements of a connection database/sql closes:
+// on a bad connection error, past the idle timeout or the max lifetime
+func (c *stmtCache) evict(dc driver.Conn) {
+	c.mu.Lock()
+	cs, ok := c.conns[dc]
+	delete(c.conns, dc)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, stmt := range cs.stmts {
+		stmt.Close()
+	}
+}
+
+// close closes the statements once the connections are not used
+func (c *stmtCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for dc, cs := range c.conns {
+		for _, stmt := range cs.stmts {
+			stmt.Close()
+		}
+		delete(c.conns, dc)
+	}
+}
+
+// cachedConn is a driver connection whose statements are in the cache, it evicts them on close.
+// The optional interfaces of the driver connection are passed through, with the fallbacks of database/sql.
+type cachedConn struct {
+	driver.Conn
+	stmts *stmtCache
+}
+
+func (c *cachedConn) Close() error {
+	c.stmts.evict(c)
+	return c.Conn.Close()
+}
+
+func (c *cachedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return pc.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *cachedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *cachedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if ec, ok := c.Conn.(driver.ExecerContext); ok {
+		return ec.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *cachedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if qc, ok := c.Conn.(driver.QueryerContext); ok {
+		return qc.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *cachedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if vc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return vc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *cachedConn) ResetSession(ctx context.Context) error {
+	if rc, ok := c.Conn.(driver.SessionResetter); ok {
+		return rc.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *cachedConn) IsValid() bool {
+	if vc, ok := c.Conn.(driver.Validator); ok {
+		return vc.IsValid()
+	}
+	return true
+}
+
+func (c *cachedConn) Ping(ctx context.Context) error {
+	if pc, ok := c.Conn.(driver.Pinger); ok {
+		return pc.Ping(ctx)
+	}
+	return nil
+}
+
+// execStmt runs a driver statement, the args are the ints, strings and nils of the stress SQLs
+func execStmt(ctx context.Context, stmt driver.Stmt, args []any) error {
+	named := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		if n, ok := a.(int); ok {
+			a = int64(n)
+		}
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+	if ec, ok := stmt.(driver.StmtExecContext); ok {
+		_, err := ec.ExecContext(ctx, named)
+		return err
+	}
+	vals := make([]driver.Value, len(named))
+	for i, nv := range named {
+		vals[i] = nv.Value
+	}
+	_, err := stmt.Exec(vals)
+	return err
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"strings"
+	"time"
+)
+
+// Step is a statement of a transaction task
+type Step struct {
+	SQL        string
+	Args       []any // the bind variables, nil for a literal SQL
+	ExpectRows *int  // the step runs as a query and another row count is an error
+}
+
+func (s Step) text() string {
+	if s.Args != nil {
+		return s.SQL + " " + fmt.Sprint(s.Args)
+	}
+	return s.SQL
+}
+
+// text is the SQL of the task for the stats, the steps of a transaction joined
+func (t Task) text() string {
+	if len(t.Steps) == 0 {
+		return Step{SQL: t.SQL, Args: t.Args}.text()
+	}
+	sqls := make([]string, 0, len(t.Steps)+2)
+	sqls = append(sqls, "BEGIN")
+	for _, step := range t.Steps {
+		sqls = append(sqls, step.text())
+	}
+	return strings.Join(append(sqls, "COMMIT"), "; ")
+}
+
+// OutcomeRetried is the outcome of a transaction committed after its first attempt was aborted
+const OutcomeRetried = "retried"
+
+// runTransaction runs the steps of the task in one transaction. The step and the commit times go to stats
+// under their own <ID>-step<N> and <ID>-commit IDs, the caller reports the whole transaction, retries included.
+// An attempt aborted by a serialization failure or a deadlock is rolled back, counted as an abort and run again,
+// up to task.Retries times. The last attempt is not an abort: the caller reports it as the error of the transaction.
+func (db *Database) runTransaction(cc *cli.Context, threadID string, s session, task Task, statsChan chan stats.OneStatement) (string, error) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := db.tryTransaction(cc, threadID, s, task, statsChan)
+		if err == nil {
+			if attempt > 0 {
+				return OutcomeRetried, nil
+			}
+			return "", nil
+		}
+		if !db.dbi.retryable(err) {
+			return "", err
+		}
+		if attempt >= task.Retries || cc.Context.Err() != nil {
+			return "", fmt.Errorf("transaction aborted %d times: %w", attempt+1, err)
+		}
+		statsChan <- stats.OneStatement{
+			ID:       task.SQLID,
+			ThreadID: threadID,
+			SQL:      task.text(),
+			Duration: time.Since(start),
+			Err:      err,
+			Aborted:  true,
+		}
+	}
+}
+
+// tryTransaction is one attempt of the transaction, rolled back if a step fails
+func (db *Database) tryTransaction(cc *cli.Context, threadID string, s session, task Task, statsChan chan stats.OneStatement) error {
+	if err := s.begin(cc); err != nil {
+		return err
+	}
+
+	report := func(id string, sql string, start time.Time, err error) {
+		timedOut := isTimeout(cc, err)
+		statsChan <- stats.OneStatement{
+			ID:       id,
+			ThreadID: threadID,
+			SQL:      sql,
+			Duration: time.Since(start),
+			Err:      err,
+			Timeout:  timedOut,
+			Aborted:  !timedOut && err != nil && db.dbi.retryable(err),
+		}
+	}
+
+	for i, step := range task.Steps {
+		start := time.Now()
+		err := runStatement(cc, s, step.SQL, step.Args, step.ExpectRows)
+		report(fmt.Sprintf("%s-step%d", task.SQLID, i+1), step.text(), start, err)
+		if err != nil {
+			s.rollback(detach(cc))
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := s.commit(cc)
+	report(task.SQLID+"-commit", "COMMIT", start, err)
+	return err
+}
@@ -0,0 +1,177 @@
+package seed
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is how often at most the autocommit inserts are written to the checkpoint.
+// Each write rewrites the file, once per row it would be slower than the inserts.
+const checkpointInterval = time.Second
+
+// checkpoint records the progress of a seed run in the out dir, so --resume can continue it.
+// With the random seed of the run the pools and the rows are generated anew the same way,
+// and each thread skips the rows it has already committed.
+type checkpoint struct {
+	RandomSeed int64                     `json:"randomSeed"`
+	Tables     map[string]*tableProgress `json:"tables"`
+
+	mu      sync.Mutex
+	path    string
+	written time.Time // of the last write
+	dirty   bool      // progress is recorded since the last write
+}
+
+type tableProgress struct {
+	Records int              `json:"records"`
+	Threads []threadProgress `json:"threads"`
+	Done    bool             `json:"done"` // seeded and indexed
+}
+
+// threadProgress tells the slice [From, To) of the table rows of a thread and how many of them are committed
+type threadProgress struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	Done int `json:"done"`
+}
+
+func checkpointPath(dir string) string {
+	return filepath.Join(dir, "seed-checkpoint.json")
+}
+
+func newCheckpoint(dir string, randomSeed int64) *checkpoint {
+	return &checkpoint{
+		RandomSeed: randomSeed,
+		Tables:     make(map[string]*tableProgress),
+		path:       checkpointPath(dir),
+	}
+}
+
+func loadCheckpoint(dir string) (*checkpoint, error) {
+	path := checkpointPath(dir)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("nothing to resume: %w", err)
+	}
+	cp := &checkpoint{path: path}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint %s: %w", path, err)
+	}
+	if cp.Tables == nil {
+		cp.Tables = make(map[string]*tableProgress)
+	}
+	return cp, nil
+}
+
+// startTable returns the progress of the table, recording its thread slices if the table is new.
+// A table seeded in part must be resumed with the same records and threads, or the slices would not match.
+func (cp *checkpoint) startTable(s *tableSeed, slices [][2]int) (*tableProgress, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if t, ok := cp.Tables[s.Table]; ok {
+		if t.Records != s.Records || len(t.Threads) != len(slices) {
+			return nil, fmt.Errorf("table %s: checkpoint has %d records on %d threads, config %d on %d",
+				s.Table, t.Records, len(t.Threads), s.Records, len(slices))
+		}
+		return t, nil
+	}
+
+	t := newTableProgress(s, slices)
+	cp.Tables[s.Table] = t
+	return t, cp.write()
+}
+
+// newTableProgress returns the progress of a table not started yet, the thread slices with no rows done
+func newTableProgress(s *tableSeed, slices [][2]int) *tableProgress {
+	t := &tableProgress{Records: s.Records, Threads: make([]threadProgress, len(slices))}
+	for i, sl := range slices {
+		t.Threads[i] = threadProgress{From: sl[0], To: sl[1]}
+	}
+	return t
+}
+
+// progress records the rows a thread has committed, done counts the rows of the previous runs as well.
+// A commit is written at once, the autocommit inserts at most every checkpointInterval
+// and when the thread is over, so a crash of an autocommit run loses the progress of up to checkpointInterval.
+func (cp *checkpoint) progress(table string, thread int, done int, commit bool) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.Tables[table].Threads[thread].Done = done
+	cp.dirty = true
+	if !commit && time.Since(cp.written) < checkpointInterval {
+		return nil
+	}
+	return cp.write()
+}
+
+// flush writes the progress recorded since the last write, if any
+func (cp *checkpoint) flush() error {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if !cp.dirty {
+		return nil
+	}
+	return cp.write()
+}
+
+// complete tells whether all the threads have committed all their rows
+func (t *tableProgress) complete() bool {
+	for _, th := range t.Threads {
+		if th.Done < th.To-th.From {
+			return false
+		}
+	}
+	return true
+}
+
+// endTable records the progress of the table once its threads are over
+func (cp *checkpoint) endTable(table string, done bool) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.Tables[table].Done = done
+	return cp.write()
+}
+
+// write replaces the file in one go, so a run killed while writing it leaves the previous one
+func (cp *checkpoint) write() error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		return err
+	}
+	cp.written = time.Now()
+	cp.dirty = false
+	return nil
+}
+
+// newRand returns a rand derived from the run seed and the names of what it generates,
+// so a pool or a thread gets the same values whatever order the work is done in
+func newRand(seed int64, names ...string) *rand.Rand {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, seed)
+	for _, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0})
+	}
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
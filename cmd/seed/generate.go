@@ -0,0 +1,75 @@
+package seed
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"log/slog"
+)
+
+// GenerateSQLs writes a new sqls file of the stressConfig of the config after the seed is done:
+// with the values of the pools file the seed saved, or sampled from the tables of the live database.
+func GenerateSQLs(cc *cli.Context) error {
+	setLogger(cc)
+
+	config, err := readConfig(cc.Path("config"))
+	if err != nil {
+		return err
+	}
+	if path := cc.Path("sqls-file"); len(path) > 0 {
+		config.Stress.SaveSQLsToFile = path
+	}
+	if len(config.Stress.SaveSQLsToFile) == 0 {
+		return fmt.Errorf("no sqls file: set sqls_to_file of the config or --sqls-file")
+	}
+
+	d := db.New(cc.String("db-type"), cc.String("db-url"))
+	d.SetPoolOptions(db.PoolOptionsFromFlags(cc, 1))
+	defer d.Close(cc)
+
+	var pools map[string]map[string]*valuePool
+	if path := cc.Path("pools-file"); len(path) > 0 {
+		if pools, err = loadPools(path); err != nil {
+			return err
+		}
+	} else {
+		if len(cc.String("db-url")) == 0 {
+			return fmt.Errorf("--pools-file or --db-url to sample the values from is required")
+		}
+		if pools, err = samplePools(&config,
+			func(table string, field string, isString bool) ([]db.ValueCount, error) {
+				return d.SampleValues(cc, table, field, isString, cc.Int("sample"))
+			}); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("writing sqls", "file", config.Stress.SaveSQLsToFile)
+	return saveSQLSelect(&config, d, pools)
+}
+
+// samplePools builds the pools of the seeded fields of the config of the values the tables have, counted by rows
+func samplePools(config *config, sample func(table string, field string, isString bool) ([]db.ValueCount, error)) (map[string]map[string]*valuePool, error) {
+	pools := make(map[string]map[string]*valuePool, len(config.Seed))
+	for _, s := range config.Seed {
+		pools[s.Table] = make(map[string]*valuePool, len(s.Fields))
+		for _, f := range s.Fields {
+			values, err := sample(s.Table, f.Field, f.FieldType == "string")
+			if err != nil {
+				return nil, err
+			}
+			p := &valuePool{fieldType: f.FieldType, counts: make([]int64, len(values))}
+			for i, v := range values {
+				if f.FieldType == "int" {
+					p.ints = append(p.ints, v.Value.(int))
+				} else {
+					p.strings = append(p.strings, v.Value.(string))
+				}
+				p.counts[i] = int64(v.Count)
+			}
+			slog.Info("sampled", "table", s.Table, "field", f.Field, "distinct", len(values))
+			pools[s.Table][f.Field] = p
+		}
+	}
+	return pools, nil
+}
@@ -0,0 +1,142 @@
+package seed
+
+import (
+	"fmt"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"io"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Generator renders the stress SQLs of the config one at a time as they are read, a workload.Reader.
+// The sqls file saveSQLSelect writes is what a Generator reads, with no file in between.
+type Generator struct {
+	config    *config
+	rd        *renderer
+	sql       int // the index of the config SQL being rendered, -1 before the first
+	repeat    int // its statements rendered so far
+	templates []*template
+}
+
+func newGenerator(config *config, rd *renderer) *Generator {
+	return &Generator{config: config, rd: rd, sql: -1}
+}
+
+// NewGenerator renders the SQLs of the config with the values of the pools file the seed saved to pools_to_file
+func NewGenerator(configPath string, poolsPath string, dialect Dialect) (*Generator, error) {
+	config, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := loadPools(poolsPath)
+	if err != nil {
+		return nil, err
+	}
+	return newGenerator(&config, newRenderer(&config, dialect, pools, rand.New(rand.NewSource(rand.Int63())))), nil
+}
+
+// MaxThreads returns the most threads a SQL of the config runs on
+func (g *Generator) MaxThreads() int {
+	threads := 0
+	for _, sql := range g.config.Stress.Sql {
+		threads = max(threads, g.group(&sql).MaxThreads())
+	}
+	return threads
+}
+
+// Next returns the group of each SQL of the config followed by its repeat statements, io.EOF after the last one
+func (g *Generator) Next() (workload.Record, error) {
+	if g.sql >= 0 && g.repeat < g.config.Stress.Sql[g.sql].Repeat {
+		sql := &g.config.Stress.Sql[g.sql]
+		st, err := g.statement(sql)
+		if err != nil {
+			return workload.Record{}, fmt.Errorf("sql %s: %w", sql.ID, err)
+		}
+		g.repeat++
+		return workload.Record{Statement: &st}, nil
+	}
+
+	g.sql++
+	if g.sql >= len(g.config.Stress.Sql) {
+		return workload.Record{}, io.EOF
+	}
+	sql := &g.config.Stress.Sql[g.sql]
+	if err := g.start(sql); err != nil {
+		return workload.Record{}, err
+	}
+	return workload.Record{Group: g.group(sql)}, nil
+}
+
+func (g *Generator) group(sql *sql) *workload.Group {
+	return &workload.Group{
+		ID:          sql.ID,
+		Threads:     sql.Threads,
+		SessionInit: append(slices.Clone(g.config.SessionInit), sql.SessionInit...),
+		Timeout:     sql.Timeout,
+		Comment:     sql.Comment,
+		Retries:     sql.Retries,
+		Profile:     sql.Profile,
+	}
+}
+
+func (g *Generator) Close() error {
+	return nil
+}
+
+// start checks the config SQL and parses its templates
+func (g *Generator) start(sql *sql) error {
+	g.repeat = 0
+	g.templates = nil
+	if len(sql.Timeout) > 0 {
+		if _, err := time.ParseDuration(sql.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout of sql %s: %w", sql.ID, err)
+		}
+	}
+	if sql.Profile != nil {
+		if _, err := sql.Profile.Stages(); err != nil {
+			return fmt.Errorf("sql %s: %w", sql.ID, err)
+		}
+	}
+	if len(sql.Transaction) > 0 && len(sql.Statement) > 0 {
+		return fmt.Errorf("sql %s has both a statement and a transaction", sql.ID)
+	}
+	if sql.Write != nil {
+		if len(sql.Transaction) > 0 || len(sql.Statement) > 0 {
+			return fmt.Errorf("sql %s has a write and a statement or a transaction", sql.ID)
+		}
+		return nil
+	}
+
+	statements := sql.Transaction
+	if len(statements) == 0 {
+		statements = []string{sql.Statement}
+	}
+	g.templates = make([]*template, len(statements))
+	for i, statement := range statements {
+		t, err := parseTemplate(statement)
+		if err != nil {
+			return fmt.Errorf("sql %s: %w", sql.ID, err)
+		}
+		g.templates[i] = t
+	}
+	return nil
+}
+
+func (g *Generator) statement(sql *sql) (workload.Statement, error) {
+	if sql.Write != nil {
+		return g.rd.renderWrite(sql.Write)
+	}
+	steps := make([]workload.Statement, len(g.templates))
+	for i, t := range g.templates {
+		st, err := g.rd.render(t)
+		if err != nil {
+			return workload.Statement{}, err
+		}
+		steps[i] = st
+	}
+	if len(sql.Transaction) > 0 {
+		return workload.Statement{Transaction: steps}, nil
+	}
+	return steps[0], nil
+}
@@ -0,0 +1,210 @@
+package seed
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Init writes a seed config for the existing tables given by --tables,
+// so one does not have to type a config for a 40 tables schema by hand.
+func Init(cc *cli.Context) error {
+	setLogger(cc)
+
+	tables, err := tablesFlag(cc)
+	if err != nil {
+		return err
+	}
+
+	d := db.New(cc.String("db-type"), cc.String("db-url"))
+	d.SetPoolOptions(db.PoolOptionsFromFlags(cc, 1))
+	defer d.Close(cc)
+	config, err := doInit(
+		func(table string) (*db.TableInfo, error) {
+			return d.DescribeTable(cc, table)
+		},
+		tables, cc.Int("records"), cc.Int("threads"))
+	if err != nil {
+		return err
+	}
+
+	return writeConfig(cc, config)
+}
+
+func tablesFlag(cc *cli.Context) ([]string, error) {
+	var tables []string
+	for _, t := range cc.StringSlice("tables") {
+		tables = append(tables, strings.Split(t, ",")...)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables given")
+	}
+	return tables, nil
+}
+
+func writeConfig(cc *cli.Context, config *config) error {
+	path := cc.Path("config")
+	if _, err := os.Stat(path); err == nil && !cc.Bool("overwrite") {
+		return fmt.Errorf("config file %s already exists, use --overwrite to replace it", path)
+	}
+
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	slog.Info("writing config", "path", path, "tables", len(config.Seed))
+	return os.WriteFile(path, b, 0644)
+}
+
+func doInit(describe func(table string) (*db.TableInfo, error), tables []string, records int, threads int) (*config, error) {
+	infos := make(map[string]*db.TableInfo, len(tables))
+	for i, table := range tables {
+		tables[i] = strings.TrimSpace(table)
+		info, err := describe(tables[i])
+		if err != nil {
+			return nil, err
+		}
+		infos[tables[i]] = info
+	}
+
+	cfg := &config{
+		Stress: stressConfig{
+			SaveSQLsToFile: "./sqls.txt",
+			Sql:            []sql{},
+		},
+	}
+	for _, table := range seedOrder(tables, infos) {
+		cfg.Seed = append(cfg.Seed, tableFromInfo(infos[table], infos, records, threads))
+	}
+	return cfg, nil
+}
+
+// seedOrder puts the referenced tables before the tables referencing them,
+// the references are seeded from the values of the referenced fields.
+func seedOrder(tables []string, infos map[string]*db.TableInfo) []string {
+	var order []string
+	state := make(map[string]int) // 1 visiting, 2 done
+	var visit func(table string)
+	visit = func(table string) {
+		if state[table] != 0 {
+			if state[table] == 1 {
+				slog.Warn("tables reference each other, references will not be seeded in order", "table", table)
+			}
+			return
+		}
+		state[table] = 1
+		for _, c := range infos[table].Columns {
+			if c.References != nil && c.References.Table != table {
+				if _, ok := infos[c.References.Table]; ok {
+					visit(c.References.Table)
+				}
+			}
+		}
+		state[table] = 2
+		order = append(order, table)
+	}
+
+	// keep the order the tables were given in where the references allow
+	for _, table := range tables {
+		visit(table)
+	}
+	return order
+}
+
+func tableFromInfo(info *db.TableInfo, infos map[string]*db.TableInfo, records int, threads int) tableSeed {
+	t := tableSeed{
+		Table:   info.Table,
+		Records: records,
+		Threads: threads,
+		Schema:  &db.TableSchema{Indexes: info.Indexes},
+	}
+
+	for _, c := range info.Columns {
+		t.Schema.Columns = append(t.Schema.Columns, db.Column{Name: c.Name, Type: c.Type, NotNull: c.NotNull})
+		if c.PrimaryKey {
+			t.Schema.PrimaryKey = append(t.Schema.PrimaryKey, c.Name)
+		}
+
+		f, ok := fieldFromColumn(c)
+		if !ok {
+			slog.Warn("column type is not supported by the generator, skipping it", "table", info.Table, "column", c.Name, "type", c.Type, "notNull", c.NotNull)
+			continue
+		}
+		// a single column primary key is unique as well
+		f.Unique = c.Unique || (c.PrimaryKey && isOnlyPK(info, c.Name))
+		if c.References != nil {
+			if _, ok := infos[c.References.Table]; ok {
+				f.References = &fieldRef{Table: c.References.Table, Field: c.References.Column}
+			} else {
+				slog.Warn("referenced table is not in the list, the reference is not seeded", "table", info.Table, "column", c.Name, "references", c.References.Table)
+			}
+		}
+		f.ID = fmt.Sprintf("id_%d", len(t.Fields)+1)
+		t.Fields = append(t.Fields, f)
+	}
+	return t
+}
+
+func isOnlyPK(info *db.TableInfo, column string) bool {
+	for _, c := range info.Columns {
+		if c.PrimaryKey && c.Name != column {
+			return false
+		}
+	}
+	return true
+}
+
+// intTypes are the integer types of the dialects and the max value generated for them.
+// The other types with int in their names, like interval, point or int4range, are not integers.
+var intTypes = map[string]int{
+	"tinyint":     127,
+	"smallint":    32767,
+	"int2":        32767,
+	"smallserial": 32767,
+	"serial2":     32767,
+	"mediumint":   8388607,
+	"int":         2147483647,
+	"integer":     2147483647,
+	"int4":        2147483647,
+	"serial":      2147483647,
+	"serial4":     2147483647,
+	"bigint":      2147483647,
+	"int8":        2147483647,
+	"bigserial":   2147483647,
+	"serial8":     2147483647,
+}
+
+// intType tells the max value of an integer column type, like int(11) unsigned or UNSIGNED BIG INT
+func intType(t string) (int, bool) {
+	for _, w := range strings.FieldsFunc(t, func(r rune) bool { return r == ' ' || r == '(' || r == ')' }) {
+		if max, ok := intTypes[w]; ok {
+			return max, true
+		}
+	}
+	return 0, false
+}
+
+// fieldFromColumn maps the column type to the generator field types: int or string
+func fieldFromColumn(c db.ColumnInfo) (fieldSeed, bool) {
+	f := fieldSeed{Field: c.Name, Encoding: "utf-8", Min: 1}
+	t := strings.ToLower(c.Type)
+	intMax, isInt := intType(t)
+	switch {
+	case isInt:
+		f.FieldType = "int"
+		f.Max = intMax
+	case strings.Contains(t, "char") || strings.Contains(t, "text") || strings.Contains(t, "clob"):
+		f.FieldType = "string"
+		f.Max = c.MaxLength
+		if f.Max <= 0 || f.Max > 65535 {
+			f.Max = 255
+		}
+	default:
+		return f, false
+	}
+	return f, true
+}
@@ -0,0 +1,443 @@
+package seed
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync/atomic"
+)
+
+// valuePool keeps the distinct values generated for one field.
+// Rows are assembled from the pools on the fly by the insert threads,
+// so only the cardinality sized pools live in memory, not the rows.
+type valuePool struct {
+	fieldType string
+	ints      []int
+	strings   []string
+	// the rows each value went to, the stress SQLs draw the values as often as the rows have them.
+	// nil if they are not counted: the values are drawn evenly
+	counts []int64
+
+	miss *missIndex // built on the first missValue call
+	cum  []int64    // the cumulative counts, built on the first sample call
+}
+
+// missIndex tells the values that are not in the pool
+type missIndex struct {
+	min, max       int // of the ints
+	minLen, maxLen int // of the strings
+	strings        map[string]bool
+	fresh          int // the fresh ints given out, above max
+}
+
+func (p *valuePool) size() int {
+	if p.fieldType == "int" {
+		return len(p.ints)
+	}
+	return len(p.strings)
+}
+
+func (p *valuePool) value(i int) any {
+	if p.fieldType == "int" {
+		return p.ints[i]
+	}
+	return p.strings[i]
+}
+
+// sample draws a value of the pool for the stress SQLs, weighted by the counts if any
+func (p *valuePool) sample(r *rand.Rand) any {
+	if p.cum == nil && p.counts != nil {
+		p.cum = make([]int64, len(p.counts))
+		total := int64(0)
+		for i, c := range p.counts {
+			total += c
+			p.cum[i] = total
+		}
+	}
+	if len(p.cum) == 0 || p.cum[len(p.cum)-1] == 0 {
+		return p.value(r.Intn(p.size()))
+	}
+	x := r.Int63n(p.cum[len(p.cum)-1])
+	return p.value(sort.Search(len(p.cum), func(i int) bool { return p.cum[i] > x }))
+}
+
+// missValue returns a value no row has: an int below the range of the pool
+// or a random string of the pool lengths that is none of its strings.
+// The ints above the range are left to freshValue, so the misses do not hit the rows the stress inserts.
+func (p *valuePool) missValue(r *rand.Rand) any {
+	if p.miss == nil {
+		p.miss = p.missIndex()
+	}
+	m := p.miss
+	if p.fieldType == "int" {
+		return m.min - 1 - r.Intn(1000)
+	}
+	for i := 0; ; i++ {
+		// short strings may all be taken, go longer
+		s := randString(r, m.minLen, m.maxLen+i/100)
+		if !m.strings[s] {
+			return s
+		}
+	}
+}
+
+// freshValue returns a value that is neither in the pool nor given out before, for a unique field of a new row:
+// the ints above the range of the pool in order, the strings the misses that are taken from then on
+func (p *valuePool) freshValue(r *rand.Rand) any {
+	if p.miss == nil {
+		p.miss = p.missIndex()
+	}
+	m := p.miss
+	if p.fieldType == "int" {
+		m.fresh++
+		return m.max + m.fresh
+	}
+	s := p.missValue(r).(string)
+	m.strings[s] = true
+	return s
+}
+
+func (p *valuePool) missIndex() *missIndex {
+	m := &missIndex{}
+	if p.fieldType == "int" {
+		if len(p.ints) > 0 {
+			m.min, m.max = slices.Min(p.ints), slices.Max(p.ints)
+		}
+		return m
+	}
+	m.strings = make(map[string]bool, len(p.strings))
+	m.minLen = math.MaxInt
+	for _, s := range p.strings {
+		m.strings[s] = true
+		m.minLen = min(m.minLen, len(s))
+		m.maxLen = max(m.maxLen, len(s))
+	}
+	m.minLen = max(min(m.minLen, m.maxLen), 1)
+	m.maxLen = max(m.maxLen, 1)
+	return m
+}
+
+// poolSize returns how many distinct values we keep for the field.
+// A unique field needs a distinct value for every record,
+// otherwise the cardinality caps it. 0 cardinality means no limit.
+func poolSize(f *fieldSeed, records int) int {
+	if f.Unique || f.Cardinality <= 0 || f.Cardinality > records {
+		return records
+	}
+	return f.Cardinality
+}
+
+// genPool generates the pool of the field values.
+// The enum values, if any, go first, followed by the random distinct values.
+func genPool(f *fieldSeed, records int, r *rand.Rand) (*valuePool, error) {
+	n := poolSize(f, records)
+	if f.Unique && len(f.Enum) > 0 {
+		return nil, fmt.Errorf("field %s: unique field can't have enum values", f.Field)
+	}
+	enum, err := enumValues(f)
+	if err != nil {
+		return nil, err
+	}
+	n = max(n, len(enum))
+
+	if f.Source != nil {
+		p, err := poolFromSource(f, n, r)
+		if err != nil {
+			return nil, err
+		}
+		if len(enum) > 0 {
+			p.prepend(enum, max(p.size(), len(enum)))
+		}
+		return p, nil
+	}
+
+	p := &valuePool{fieldType: f.FieldType}
+	switch f.FieldType {
+	case "int":
+		if span := f.Max - f.Min + 1; span < n {
+			if f.Unique {
+				return nil, fmt.Errorf("field %s: %d unique values requested from the interval [%d, %d]", f.Field, n, f.Min, f.Max)
+			}
+			n = span
+		}
+		p.ints = distinctInts(n, f.Min, f.Max, r)
+	case "string":
+		if space := stringSpace(f.Min, f.Max); space < n {
+			if f.Unique {
+				return nil, fmt.Errorf("field %s: %d unique values requested of the %d strings of %d to %d chars", f.Field, n, space, f.Min, f.Max)
+			}
+			n = space
+		}
+		p.strings = distinctStrings(n, f.Min, f.Max, r)
+	default:
+		return nil, fmt.Errorf("invalid %s field type: %s", f.Field, f.FieldType)
+	}
+
+	if len(enum) > 0 {
+		p.prepend(enum, n)
+	}
+	return p, nil
+}
+
+// enumValues returns the enum values of the field typed per the field type.
+// JSON numbers come as float64.
+func enumValues(f *fieldSeed) ([]any, error) {
+	vals := make([]any, len(f.Enum))
+	total := 0.0
+	for i, e := range f.Enum {
+		total += e.Weight
+		switch v := e.Value.(type) {
+		case float64:
+			if f.FieldType == "int" {
+				vals[i] = int(v)
+				continue
+			}
+		case int:
+			if f.FieldType == "int" {
+				vals[i] = v
+				continue
+			}
+		case string:
+			if f.FieldType == "string" {
+				vals[i] = v
+				continue
+			}
+		}
+		return nil, fmt.Errorf("field %s: enum value %v is not of the field type %s", f.Field, e.Value, f.FieldType)
+	}
+	if total > 1.0001 {
+		return nil, fmt.Errorf("field %s: enum weights add up to %f, more than 1", f.Field, total)
+	}
+	return vals, nil
+}
+
+// prepend puts the enum values in front of the pool dropping their duplicates, keeping the pool size n
+func (p *valuePool) prepend(enum []any, n int) {
+	seen := make(map[any]bool, len(enum))
+	for _, v := range enum {
+		seen[v] = true
+	}
+	if p.fieldType == "int" {
+		ints := make([]int, 0, n)
+		for _, v := range enum {
+			ints = append(ints, v.(int))
+		}
+		for _, v := range p.ints {
+			if len(ints) < n && !seen[v] {
+				ints = append(ints, v)
+			}
+		}
+		p.ints = ints
+		return
+	}
+	strs := make([]string, 0, n)
+	for _, v := range enum {
+		strs = append(strs, v.(string))
+	}
+	for _, v := range p.strings {
+		if len(strs) < n && !seen[v] {
+			strs = append(strs, v)
+		}
+	}
+	p.strings = strs
+}
+
+// distinctInts picks n distinct random ints from [min, max].
+// Sorting and compacting keeps the memory at the size of the result,
+// a set of 50M ints would take several times more.
+func distinctInts(n int, min int, max int, r *rand.Rand) []int {
+	vals := make([]int, 0, n)
+	for len(vals) < n {
+		for len(vals) < n {
+			vals = append(vals, r.Intn(max-min+1)+min)
+		}
+		sort.Ints(vals)
+		vals = compact(vals)
+	}
+	r.Shuffle(len(vals), func(i, j int) { vals[i], vals[j] = vals[j], vals[i] })
+	return vals
+}
+
+// stringSpace returns how many distinct strings of minLen to maxLen chars randString makes, math.MaxInt if more
+func stringSpace(minLen int, maxLen int) int {
+	total, n := 0, 1 // n is the strings of length l
+	for l := 0; l <= maxLen; l++ {
+		if l >= minLen {
+			if total > math.MaxInt-n {
+				return math.MaxInt
+			}
+			total += n
+		}
+		if l < maxLen && n > math.MaxInt/len(allChars) {
+			return math.MaxInt
+		}
+		n *= len(allChars)
+	}
+	return total
+}
+
+// distinctStrings picks n distinct random strings of minLen to maxLen chars, n must not exceed their stringSpace
+func distinctStrings(n int, minLen int, maxLen int, r *rand.Rand) []string {
+	vals := make([]string, 0, n)
+	for len(vals) < n {
+		for len(vals) < n {
+			vals = append(vals, randString(r, minLen, maxLen))
+		}
+		sort.Strings(vals)
+		vals = compact(vals)
+	}
+	r.Shuffle(len(vals), func(i, j int) { vals[i], vals[j] = vals[j], vals[i] })
+	return vals
+}
+
+// compact removes consecutive duplicates of a sorted slice in place
+func compact[T comparable](s []T) []T {
+	if len(s) == 0 {
+		return s
+	}
+	i := 1
+	for j := 1; j < len(s); j++ {
+		if s[j] != s[i-1] {
+			s[i] = s[j]
+			i++
+		}
+	}
+	return s[:i]
+}
+
+// fieldGen picks the values of one field
+type fieldGen struct {
+	pool      *valuePool
+	unique    bool
+	nullRatio float64
+	enumCum   []float64 // cumulative weights of the enum values at the head of the pool
+	zipf      *rand.Zipf
+}
+
+func newFieldGen(f *fieldSeed, pool *valuePool, r *rand.Rand) *fieldGen {
+	g := &fieldGen{pool: pool, unique: f.Unique, nullRatio: f.NullRatio}
+	// the referenced pool has no enum of this field
+	if f.References == nil {
+		total := 0.0
+		for _, e := range f.Enum {
+			total += e.Weight
+			g.enumCum = append(g.enumCum, total)
+		}
+	}
+	if f.Distribution == "zipf" && pool.size()-len(g.enumCum) > 1 {
+		skew := f.Skew
+		if skew <= 1 {
+			skew = 1.1
+		}
+		g.zipf = rand.NewZipf(r, skew, 1, uint64(pool.size()-len(g.enumCum)-1))
+	}
+	return g
+}
+
+func (g *fieldGen) pick(r *rand.Rand, row int) any {
+	i := g.index(r, row)
+	if i < 0 {
+		return nil
+	}
+	return g.pool.value(i)
+}
+
+// index picks the pool index of the value, -1 for NULL
+func (g *fieldGen) index(r *rand.Rand, row int) int {
+	if g.unique {
+		return row
+	}
+	if g.nullRatio > 0 && r.Float64() < g.nullRatio {
+		return -1
+	}
+	if len(g.enumCum) > 0 {
+		x := r.Float64()
+		for i, c := range g.enumCum {
+			if x < c {
+				return i
+			}
+		}
+	}
+	first := len(g.enumCum)
+	if first == g.pool.size() {
+		// nothing but the enum values in the pool
+		first = 0
+	}
+	if g.zipf != nil {
+		return first + int(g.zipf.Uint64())
+	}
+	return first + r.Intn(g.pool.size()-first)
+}
+
+// valueCounts counts the rows each pool value of the non unique fields of a table went to: field -> counts by pool index.
+// The insert threads of the table add to it together.
+type valueCounts map[string][]int64
+
+func newValueCounts(s *tableSeed, pools map[string]*valuePool) valueCounts {
+	counts := make(valueCounts, len(s.Fields))
+	for _, f := range s.Fields {
+		if !f.Unique {
+			counts[f.Field] = make([]int64, pools[f.Field].size())
+		}
+	}
+	return counts
+}
+
+// rowGenerator produces the rows of one table from its field pools.
+// Unique fields consume their pool in order starting at the first row of the thread,
+// so the threads never insert the same unique value twice.
+type rowGenerator struct {
+	fields []*fieldGen
+	r      *rand.Rand
+	row    int
+	counts [][]int64 // of the fields, nil if not counted
+}
+
+func newRowGenerator(s *tableSeed, pools map[string]*valuePool, firstRow int, r *rand.Rand) *rowGenerator {
+	g := &rowGenerator{
+		fields: make([]*fieldGen, len(s.Fields)),
+		r:      r,
+		row:    firstRow,
+	}
+	for i := range s.Fields {
+		g.fields[i] = newFieldGen(&s.Fields[i], pools[s.Fields[i].Field], r)
+	}
+	return g
+}
+
+// fresh returns a row for the stress inserts and updates: the unique fields get values no row has,
+// the others are picked as for the seeded rows
+func (g *rowGenerator) fresh() []any {
+	vals := make([]any, len(g.fields))
+	for i := range g.fields {
+		vals[i] = g.freshField(i)
+	}
+	return vals
+}
+
+// freshField returns the value of the i-th field of a fresh row
+func (g *rowGenerator) freshField(i int) any {
+	f := g.fields[i]
+	if f.unique {
+		return f.pool.freshValue(g.r)
+	}
+	return f.pick(g.r, 0)
+}
+
+func (g *rowGenerator) next() []any {
+	vals := make([]any, len(g.fields))
+	for i, f := range g.fields {
+		j := f.index(g.r, g.row)
+		if j < 0 {
+			continue
+		}
+		vals[i] = f.pool.value(j)
+		if g.counts != nil && g.counts[i] != nil {
+			atomic.AddInt64(&g.counts[i][j], 1)
+		}
+	}
+	g.row++
+	return vals
+}
@@ -0,0 +1,129 @@
+package seed
+
+import (
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"log/slog"
+	"math"
+)
+
+// a value goes to the enum if it is at least this many times more frequent than the average value
+// and its count is that many standard deviations above the average, so the sampling noise is not taken for skew
+const (
+	frequentFactor = 2
+	frequentSigmas = 5
+)
+
+// Profile writes a seed config for the existing tables like Init does,
+// but with the cardinality, min, max, NULL share, distribution and the frequent values
+// taken from the data of the tables, so a staging DB can be seeded to look like production
+// without copying the production rows.
+func Profile(cc *cli.Context) error {
+	setLogger(cc)
+
+	tables, err := tablesFlag(cc)
+	if err != nil {
+		return err
+	}
+
+	d := db.New(cc.String("db-type"), cc.String("db-url"))
+	d.SetPoolOptions(db.PoolOptionsFromFlags(cc, 1))
+	defer d.Close(cc)
+	config, err := doInit(
+		func(table string) (*db.TableInfo, error) {
+			return d.DescribeTable(cc, table)
+		},
+		tables, cc.Int("records"), cc.Int("threads"))
+	if err != nil {
+		return err
+	}
+
+	for i := range config.Seed {
+		t := &config.Seed[i]
+		columns := make(map[string]bool, len(t.Fields))
+		for _, f := range t.Fields {
+			columns[f.Field] = f.FieldType == "string"
+		}
+		p, err := d.ProfileTable(cc, t.Table, columns, cc.Int("sample"), cc.Int("top"))
+		if err != nil {
+			return err
+		}
+		applyProfile(t, p, cc.Int("records"))
+	}
+
+	return writeConfig(cc, config)
+}
+
+// applyProfile sets the table seed config per the table profile.
+// records is the number of rows to seed, 0 to seed as many as the profiled table has.
+func applyProfile(t *tableSeed, p *db.TableProfile, records int) {
+	t.Records = records
+	if records <= 0 {
+		t.Records = p.Rows
+	}
+
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		c, ok := p.Columns[f.Field]
+		if !ok || c.Sampled == 0 {
+			continue
+		}
+		slog.Info("profiled", "table", t.Table, "field", f.Field, "sampled", c.Sampled, "nonNull", c.NonNull,
+			"distinct", c.Distinct, "min", c.Min, "max", c.Max, "minLen", c.MinLen, "maxLen", c.MaxLen, "avgLen", c.AvgLen,
+			"p10Len", c.LengthQuantile(0.1), "p50Len", c.LengthQuantile(0.5), "p90Len", c.LengthQuantile(0.9))
+
+		if !f.Unique {
+			f.NullRatio = round(1 - float64(c.NonNull)/float64(c.Sampled))
+		}
+
+		switch f.FieldType {
+		case "int":
+			f.Min, f.Max = c.Min, c.Max
+		case "string":
+			f.Min, f.Max = c.MinLen, c.MaxLen
+		}
+
+		// the referenced pool, and the unique fields get a distinct value per row anyway
+		if f.Unique || f.References != nil || c.NonNull == 0 {
+			continue
+		}
+
+		f.Cardinality = cardinality(c, p.Rows, t.Records)
+		f.Distribution = "uniform"
+		f.Enum = nil
+		// expected rows per value if they were spread evenly, Poisson-ish
+		expected := float64(c.NonNull) / float64(c.Distinct)
+		threshold := max(frequentFactor*expected, expected+frequentSigmas*math.Sqrt(expected))
+		for _, top := range c.Top {
+			if float64(top.Count) < threshold {
+				break
+			}
+			share := float64(top.Count) / float64(c.NonNull)
+			f.Enum = append(f.Enum, enumValue{Value: top.Value, Weight: round(share)})
+		}
+
+		// all the top values are frequent, so the skew goes on past them: model it with zipf
+		// f(k) ~ 1/k^s, so s = ln(f(1)/f(n)) / ln(n)
+		if n := len(f.Enum); n > 1 && n == len(c.Top) && n < c.Distinct {
+			first, last := float64(c.Top[0].Count), float64(c.Top[n-1].Count)
+			if skew := math.Log(first/last) / math.Log(float64(n)); skew > 1 {
+				f.Distribution = "zipf"
+				f.Skew = round(min(skew, 5))
+			}
+		}
+	}
+}
+
+// cardinality estimates the distinct values of the seeded field.
+// The distinct count of a sample underestimates the nearly unique columns, those are scaled by the rows,
+// and so are they when we seed a different number of rows than the profiled table has.
+func cardinality(c *db.ColumnProfile, tableRows int, records int) int {
+	if c.Distinct*10 < c.NonNull*9 || tableRows == 0 {
+		return min(c.Distinct, records)
+	}
+	return max(1, int(float64(c.Distinct)*float64(records)/float64(c.Sampled)))
+}
+
+func round(f float64) float64 {
+	return math.Round(f*10000) / 10000
+}
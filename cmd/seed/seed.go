@@ -6,8 +6,8 @@ import (
 	"github.com/urfave/cli/v2"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
-	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stress"
-	"golang.org/x/sync/syncmap"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"io"
 	"log"
 	"log/slog"
 	"math/rand"
@@ -27,6 +27,28 @@ type fieldSeed struct {
 	Min         int    `json:"min" binding:"required"`
 	Max         int    `json:"max" binding:"required"`
 	Cardinality int    `json:"cardinality" binding:"required"`
+	// take the values of a field of a table seeded before, e.g. for a foreign key
+	References *fieldRef `json:"references,omitempty"`
+	// share of the rows (0..1) that get NULL in this field
+	NullRatio float64 `json:"nullRatio,omitempty"`
+	// how the values are picked from the pool: uniform (default) or zipf
+	Distribution string  `json:"distribution,omitempty"`
+	Skew         float64 `json:"skew,omitempty"` // zipf exponent, > 1
+	// values with the share of the non NULL rows (0..1) each of them takes,
+	// the rest of the rows pick their values from the pool per the distribution
+	Enum []enumValue `json:"enum,omitempty"`
+	// sample the values from a file instead of generating them
+	Source *valueSource `json:"source,omitempty"`
+}
+
+type enumValue struct {
+	Value  any     `json:"value"`
+	Weight float64 `json:"weight"`
+}
+
+type fieldRef struct {
+	Table string `json:"table"`
+	Field string `json:"field"`
 }
 
 type tableSeed struct {
@@ -34,6 +56,17 @@ type tableSeed struct {
 	Records int         `json:"records" binding:"required"`
 	Threads int         `json:"insertThreads" binding:"required"`
 	Fields  []fieldSeed `json:"fields" binding:"required"`
+	// optional, used by --create-schema and --drop-existing. Columns default to the fields.
+	Schema *db.TableSchema `json:"schema,omitempty"`
+	// load the rows from a CSV file instead of generating them
+	Source *tableSource `json:"source,omitempty"`
+	// inserts per transaction on each insert thread, 0 to insert in autocommit mode
+	CommitEvery int `json:"commitEvery,omitempty"`
+	// what to do with the rows violating a unique key: error (the default), ignore or update
+	OnConflict string `json:"onConflict,omitempty"`
+	// caps the inserts per second of all the table threads together and of each thread, 0 for no limit
+	RowsPerSecond       float64 `json:"rowsPerSecond,omitempty"`
+	ThreadRowsPerSecond float64 `json:"threadRowsPerSecond,omitempty"`
 }
 
 type sql struct {
@@ -42,23 +75,72 @@ type sql struct {
 	Repeat    int    `json:"repeat" binding:"required"`
 	Threads   int    `json:"threads" binding:"required"`
 	Comment   string `json:"comment" binding:"required"`
+	// statements the connections running this SQL run once connected, after the global ones
+	SessionInit []string `json:"sessionInit,omitempty"`
+	// cancel the statements running longer, like 2s, instead of the --statement-timeout of the stress
+	Timeout string `json:"timeout,omitempty"`
+	// the statements of a transaction, run as one unit instead of the statement, .jsonl sqls files only
+	Transaction []string `json:"transaction,omitempty"`
+	// how many times a transaction aborted by a serialization failure or a deadlock is run again
+	Retries *int `json:"retries,omitempty"`
+	// an INSERT, UPDATE or DELETE built of the seed config of a table instead of the statement
+	Write *writeDef `json:"write,omitempty"`
+	// ramp, step or spike the threads over time instead of running threads all along
+	Profile *workload.Profile `json:"profile,omitempty"`
+}
+
+// writeDef is a write statement of a seeded table, rendered anew for each repeat
+type writeDef struct {
+	Op    string `json:"op"` // insert, update or delete
+	Table string `json:"table"`
+	// update, delete: the WHERE fields, each gets a value sampled from its seeded ones.
+	// The primary key of the schema or the unique field by default
+	Key []string `json:"key,omitempty"`
+	// update: the fields set to fresh values, all but the key ones by default
+	Set []string `json:"set,omitempty"`
 }
 
 type stressConfig struct {
 	SaveSQLsToFile string `json:"sqls_to_file"`
-	Sql            []sql  `json:"sql"`
+	// the value pools of the seed, for the stress to render the SQLs of the config on the fly instead of reading sqls_to_file
+	SavePoolsToFile string `json:"pools_to_file,omitempty"`
+	Sql             []sql  `json:"sql"`
+	// render the placeholders as bind variables, their values go to an ARGS line ahead of the SQL,
+	// and the stress runs the SQLs as prepared statements
+	BindArgs bool `json:"bindArgs,omitempty"`
 }
 
 type config struct {
 	Seed   []tableSeed  `json:"seed"`
 	Stress stressConfig `json:"stressConfig"`
+	// statements each connection of the seed and of the stress SQLs runs once connected, like SET work_mem = '64MB'
+	SessionInit []string `json:"sessionInit,omitempty"`
 }
 
+// the placeholder kinds of the statement templates
+const (
+	placeholderIn      = "in"      // a random length list of seeded values, the default
+	placeholderValue   = "value"   // one seeded value
+	placeholderBetween = "between" // lo AND hi, two seeded values in order
+	placeholderLike    = "like"    // a LIKE pattern of a piece of a seeded string
+	placeholderLimit   = "limit"   // n OFFSET m
+	placeholderNew     = "new"     // the value of the field in a fresh row, for INSERT and UPDATE
+)
+
 type whereListDef struct {
+	Kind   string `json:"kind,omitempty"`
 	Table  string `json:"table"`
 	Field  string `json:"field"`
-	MinLen int    `json:"minLen"`
+	MinLen int    `json:"minLen"` // the IN list length, the LIKE piece length
 	MaxLen int    `json:"maxLen"`
+	// in, value: share (0..1) of the values that are in no row, to measure the lookups of absent keys
+	MissRatio float64 `json:"missRatio,omitempty"`
+	// like: prefix (the default), suffix or contains
+	Match string `json:"match,omitempty"`
+	// limit: the row count range and the largest offset, no OFFSET when 0
+	Min       int `json:"min,omitempty"`
+	Max       int `json:"max,omitempty"`
+	MaxOffset int `json:"maxOffset,omitempty"`
 }
 
 type dbseeder interface {
@@ -66,58 +148,70 @@ type dbseeder interface {
 		threadID string,
 		table string,
 		fields []string,
-		fieldValues []map[string]any,
+		rows db.RowSource,
+		opts db.InsertOptions,
 		statsChan chan stats.OneStatement,
 		wg *sync.WaitGroup)
 
-	WriteSQLSelect(f *os.File, sqlStatement string, jsonStrings []string, tokens []string) error
+	PrepareTable(cc *cli.Context, table string, schema *db.TableSchema, opts db.SchemaOptions) error
+	CreateIndexes(cc *cli.Context, table string, schema *db.TableSchema, statsChan chan stats.OneStatement) error
+	Dialect
+}
+
+// Dialect renders the stress SQLs per the db type
+type Dialect interface {
+	// RenderSQLSelect puts the rendered placeholders into the statement template
+	RenderSQLSelect(sqlStatement string, jsonStrings []string, tokens []string) (string, error)
+	// Literal quotes the values put into the stress SQLs per the db type
+	Literal(v any) string
+	BindVar(i int) string // the placeholder of the i-th, 0 based, bind variable of the db type
 }
 
-var re = regexp.MustCompile(`{[a-zA-Z_\-0-9":, ]+}`)
+var re = regexp.MustCompile(`{[a-zA-Z_\-0-9":,. ]+}`)
 
 // to allow DB mocking
 func Seed(cc *cli.Context) error {
-	opts := &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}
-	logLevel := cc.String("log-level")
-	switch logLevel {
-	case "debug":
-		opts = &slog.HandlerOptions{
-			Level: slog.LevelDebug,
-		}
-	case "error":
-		opts = &slog.HandlerOptions{
-			Level: slog.LevelError,
-		}
-	case "warn":
-		opts = &slog.HandlerOptions{
-			Level: slog.LevelWarn,
-		}
-	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, opts)))
+	setLogger(cc)
 
 	path := cc.Path("config")
 	if len(path) == 0 {
 		return fmt.Errorf("no config path given")
 	}
 
-	b, err := os.ReadFile(path)
+	config, err := readConfig(path)
 	if err != nil {
-		log.Fatalf("[ERROR] failed to open config file %s %s", path, err)
+		log.Fatalf("[ERROR] %s", err)
+		return err
 	}
 
-	var config config
-	if err = json.Unmarshal(b, &config); err != nil {
-		log.Fatalf("Failed to load from json `%s`: %s\n", path, err)
-		return err
+	if output := cc.String("output"); len(output) > 0 {
+		if cc.Bool("resume") {
+			return fmt.Errorf("--resume does not work with --output, the files are written anew")
+		}
+		return seedToFiles(cc, output, config)
+	}
+	if len(cc.String("db-url")) == 0 || len(cc.String("db-type")) == 0 {
+		return fmt.Errorf("--db-url and --db-type are required unless the rows go to files with --output")
 	}
 
-	// dbSeeder := db.New(cc.String("dbseeder-type"), cc.String("dbseeder-url"))
+	// one pool for the run, the tables are seeded one after another
+	threads := 0
+	for _, s := range config.Seed {
+		threads = max(threads, s.Threads)
+	}
+	poolOpts := db.PoolOptionsFromFlags(cc, threads)
+	poolOpts.SessionInit = append(poolOpts.SessionInit, config.SessionInit...)
+	if len(poolOpts.SessionInit) > 0 {
+		stats.SetMeta("sessionInit", strings.Join(poolOpts.SessionInit, "; "))
+	}
+	dbSeeder := db.New(cc.String("db-type"), cc.String("db-url"))
+	dbSeeder.SetPoolOptions(poolOpts)
+	defer dbSeeder.Close(cc)
+
 	err = doSeed(cc,
 		// had to wrap it in a func. Passing db.New() directly gives a syntax error
 		func(dbType string, dbUrl string) dbseeder {
-			return db.New(dbType, dbUrl)
+			return dbSeeder
 		},
 		config)
 	if err != nil {
@@ -128,6 +222,28 @@ func Seed(cc *cli.Context) error {
 	return nil
 }
 
+// seedToFiles writes the rows to per-table files in the out dir instead of a database.
+// The sql and copy dumps are in the --db-type dialect and carry the DDL the schema flags call for.
+func seedToFiles(cc *cli.Context, output string, config config) error {
+	if (output == "sql" || output == "copy") && len(cc.String("db-type")) == 0 {
+		return fmt.Errorf("--db-type is required for the %s output", output)
+	}
+	sink, err := db.NewFileSink(cc.String("out-dir"), output, cc.String("db-type"), cc.Bool("gzip"))
+	if err != nil {
+		return err
+	}
+
+	err = doSeed(cc,
+		func(dbType string, dbUrl string) dbseeder {
+			return sink
+		},
+		config)
+	if closeErr := sink.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func doSeed(cc *cli.Context,
 	new func(dbtype string, dburl string) dbseeder,
 	config config,
@@ -136,213 +252,552 @@ func doSeed(cc *cli.Context,
 	// Deprecated: As of Go 1.20 there is no reason to call Seed with a random value.
 	// rand.Seed(time.Now().UTC().UnixNano())
 
+	// the pools and the rows are derived from the random seed, so a run can be repeated or resumed.
+	// The files of --output are written anew, they have no checkpoint.
+	toFiles := len(cc.String("output")) > 0
+	var cp *checkpoint
+	var randomSeed int64
+	if cc.Bool("resume") {
+		var err error
+		if cp, err = loadCheckpoint(cc.String("out-dir")); err != nil {
+			return err
+		}
+		randomSeed = cp.RandomSeed
+		slog.Info("resuming seed", "checkpoint", cp.path, "randomSeed", randomSeed)
+	} else {
+		randomSeed = cc.Int64("random-seed")
+		if randomSeed == 0 {
+			randomSeed = rand.Int63()
+		}
+		if !toFiles {
+			cp = newCheckpoint(cc.String("out-dir"), randomSeed)
+		}
+		slog.Info("seeding", "randomSeed", randomSeed)
+	}
+
 	statsChan := make(chan stats.OneStatement, 1)
 
-	// table -> []map[fieldName]any: int | string. To keep all generated values per table
-	var seedMap syncmap.Map
-	// table -> map[filedName]->fieldType. Need it to know if we need to do quotes: string or not
-	tableFieldTypes := make(map[string]map[string]string, len(config.Seed))
+	// table -> field -> pool of the values generated for it.
+	// The rows themselves are generated on the fly by the insert threads.
+	pools := make(map[string]map[string]*valuePool, len(config.Seed))
+	// table -> the rows per pool value of its fields, for the stress SQLs to draw the values as often as the rows have them
+	counts := make(map[string]valueCounts, len(config.Seed))
 
 	// loop by tables
-	for _, seed := range config.Seed {
-		// generate "this table" -> []map[fieldName]-> value of type any(int or string)
-		genOneTable(&seedMap, &seed)
-		tableFieldTypes[seed.Table] = make(map[string]string, len(seed.Fields))
-		// populate tableFieldTypes for the current table
-		for _, field := range seed.Fields {
-			tableFieldTypes[seed.Table][field.Field] = field.FieldType
+	for i := range config.Seed {
+		if err := insertOptions(&config.Seed[i]).Conflict.Validate(cc.String("db-type")); err != nil {
+			return fmt.Errorf("table %s: %w", config.Seed[i].Table, err)
+		}
+		tablePools, err := genTablePools(&config.Seed[i], pools, randomSeed)
+		if err != nil {
+			return err
 		}
+		pools[config.Seed[i].Table] = tablePools
+	}
+
+	schemaOpts := db.SchemaOptions{
+		Create:       cc.Bool("create-schema"),
+		DropExisting: cc.Bool("drop-existing"),
+		Truncate:     cc.Bool("truncate"),
 	}
 
 	// start stats collector
 	var wgStats sync.WaitGroup
 	wgStats.Add(1)
 	go stats.Collect(cc, statsChan, &wgStats)
+	// the table an insert thread failed on, the ones after it may need its rows
+	failed := ""
 	// by tables
 	for _, seed := range config.Seed {
+		if cc.Context.Err() != nil {
+			break
+		}
+		// the stress SQLs draw only the values the rows have, so the rows seeded before are counted too
+		if seed.Source == nil {
+			counts[seed.Table] = newValueCounts(&seed, pools[seed.Table])
+		}
+		var progress *tableProgress
+		started := false
+		if cp != nil {
+			progress, started = cp.Tables[seed.Table]
+		}
+		if started && progress.Done {
+			slog.Info("table is already seeded, skipping it", "table", seed.Table)
+			for i, th := range progress.Threads {
+				countSeeded(&seed, pools[seed.Table], i, th, randomSeed, counts[seed.Table])
+			}
+			continue
+		}
+
+		schema := tableSchema(&seed)
+		// a table seeded in part keeps its rows
+		if (schemaOpts.CreatesTables() || schemaOpts.Truncate) && !started {
+			err := new(cc.String("db-type"), cc.String("db-url")).PrepareTable(cc, seed.Table, schema, schemaOpts)
+			if err != nil {
+				return err
+			}
+		}
+
 		fields := make([]string, len(seed.Fields))
 		for i, f := range seed.Fields {
 			fields[i] = f.Field
 		}
 
-		slice, _ := seedMap.Load(seed.Table)
-		typedSlice := slice.([]map[string]any)
-
-		var wg sync.WaitGroup
-		// spawn seed.Threads, each to insert seed.Records records from typedSlice.
-		for i := 0; i < seed.Threads; i++ {
-			s := typedSlice
-			perThread := seed.Records / seed.Threads
+		// spawn seed.Threads, each to insert its share of seed.Records records.
+		slices := make([][2]int, seed.Threads)
+		perThread := seed.Records / seed.Threads
+		for i := range slices {
+			slices[i] = [2]int{i * perThread, (i + 1) * perThread}
 			if i == seed.Threads-1 {
 				// pick all, incl the reminder
-				s = typedSlice[i*perThread:]
-				fmt.Println("SEEDING", i, i*perThread, seed.Records)
-			} else {
-				s = typedSlice[i*perThread : (i+1)*perThread]
-				fmt.Println("SEEDING", i, i*perThread, (i+1)*perThread)
+				slices[i][1] = seed.Records
+			}
+		}
+		progress = newTableProgress(&seed, slices)
+		if cp != nil {
+			var err error
+			if progress, err = cp.startTable(&seed, slices); err != nil {
+				return err
+			}
+		}
+
+		var tableLimiter *db.TokenBucket
+		if seed.RowsPerSecond > 0 {
+			tableLimiter = db.NewTokenBucket(seed.RowsPerSecond)
+		}
+
+		var wg sync.WaitGroup
+		for i, sl := range slices {
+			from, to, done := sl[0], sl[1], progress.Threads[i].Done
+			fmt.Println("SEEDING", i, from, to)
+			if done >= to-from {
+				countSeeded(&seed, pools[seed.Table], i, progress.Threads[i], randomSeed, counts[seed.Table])
+				continue
+			}
+
+			// make each thread insert "different" values
+			rows := rowSource(&seed, pools[seed.Table], from, to, newRand(randomSeed, seed.Table, strconv.Itoa(i)), counts[seed.Table])
+			if seed.Source != nil {
+				var err error
+				if rows, err = csvRowSource(&seed, from, to); err != nil {
+					return err
+				}
+			}
+			// the same rows as the previous run generated and committed
+			for j := 0; j < done; j++ {
+				rows()
+			}
+			if done > 0 {
+				slog.Info("resuming thread", "table", seed.Table, "thread", i, "done", done, "left", to-from-done)
+			}
+
+			opts := insertOptions(&seed)
+			if tableLimiter != nil {
+				opts.Limiters = append(opts.Limiters, tableLimiter)
+			}
+			if seed.ThreadRowsPerSecond > 0 {
+				opts.Limiters = append(opts.Limiters, db.NewTokenBucket(seed.ThreadRowsPerSecond))
+			}
+			table, thread := seed.Table, i
+			if cp != nil {
+				// each commit is written, the inserts of autocommit at most every checkpointInterval
+				commits := seed.CommitEvery > 0
+				opts.Progress = func(rows int) {
+					if err := cp.progress(table, thread, done+rows, commits); err != nil {
+						slog.Error("failed to write checkpoint", "path", cp.path, "error", err)
+					}
+				}
 			}
 
 			dbSeeder := new(cc.String("db-type"), cc.String("db-url"))
 			wg.Add(1)
-			go dbSeeder.SeedTable(cc,
-				fmt.Sprintf("thread-%d", i),
-				seed.Table,
-				fields,
-				// make each thread insert "different" values
-				s,
-				statsChan,
-				&wg)
+			go func() {
+				defer wg.Done()
+				var threadWg sync.WaitGroup
+				threadWg.Add(1)
+				dbSeeder.SeedTable(cc,
+					fmt.Sprintf("thread-%d", thread),
+					table,
+					fields,
+					rows,
+					opts,
+					statsChan,
+					&threadWg)
+				// the inserts since the last write of the checkpoint
+				if err := cp.flush(); err != nil {
+					slog.Error("failed to write checkpoint", "path", cp.path, "error", err)
+				}
+			}()
 		}
 
 		wg.Wait()
+
+		// a thread that failed or was interrupted leaves the table to resume.
+		// The file sink reports no progress, a failed write stops the run.
+		done := (toFiles || progress.complete()) && cc.Context.Err() == nil
+		// indexes are built on the loaded table: it's faster and we get the build time
+		if schemaOpts.CreatesTables() && done {
+			err := new(cc.String("db-type"), cc.String("db-url")).CreateIndexes(cc, seed.Table, schema, statsChan)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cp != nil {
+			if err := cp.endTable(seed.Table, done); err != nil {
+				return err
+			}
+		}
+		if !done && cc.Context.Err() == nil {
+			failed = seed.Table
+			break
+		}
 	}
 
+	interrupted := cc.Context.Err() != nil
+	if interrupted {
+		stats.MarkInterrupted()
+	}
 	statsChan <- stats.OneStatement{
 		ID: stats.POISON_PILL,
 	}
 	wgStats.Wait()
 
-	return saveSQLSelect(&config, new(cc.String("db-type"), cc.String("db-url")), &seedMap, tableFieldTypes)
+	if interrupted {
+		return fmt.Errorf("seed interrupted, the committed rows are kept: continue it with --resume")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("table %s is short of rows, an insert thread failed: the committed rows are kept, fix the cause and continue with --resume", failed)
+	}
+	pools = countedPools(pools, counts)
+	if len(config.Stress.SavePoolsToFile) > 0 {
+		if err := savePools(config.Stress.SavePoolsToFile, pools); err != nil {
+			return err
+		}
+		slog.Info("saved the value pools", "file", config.Stress.SavePoolsToFile)
+		// the stress renders the SQLs itself
+		if len(config.Stress.SaveSQLsToFile) == 0 {
+			return nil
+		}
+	}
+	return saveSQLSelect(&config, new(cc.String("db-type"), cc.String("db-url")), pools)
+}
+
+func readConfig(path string) (config, error) {
+	var config config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to open config file %s: %w", path, err)
+	}
+	if err = json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("failed to load from json %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func setLogger(cc *cli.Context) {
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}
+	logLevel := cc.String("log-level")
+	switch logLevel {
+	case "debug":
+		opts = &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}
+	case "error":
+		opts = &slog.HandlerOptions{
+			Level: slog.LevelError,
+		}
+	case "warn":
+		opts = &slog.HandlerOptions{
+			Level: slog.LevelWarn,
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, opts)))
+}
+
+// tableSchema returns the schema section of the table config.
+// Columns that are not described there are derived from the seeded fields.
+func tableSchema(s *tableSeed) *db.TableSchema {
+	schema := db.TableSchema{}
+	if s.Schema != nil {
+		schema = *s.Schema
+	}
+	if len(schema.Columns) > 0 {
+		return &schema
+	}
+
+	for _, f := range s.Fields {
+		// empty values of the CSV rows are NULLs
+		column := db.Column{Name: f.Field, Type: "INTEGER", NotNull: f.NullRatio == 0 && s.Source == nil}
+		if f.FieldType == "string" {
+			column.Type = fmt.Sprintf("VARCHAR(%d)", f.Max)
+			// MySQL rows are limited to 64KB, and the max length of the CSV values may be unknown
+			if f.Max > 16000 || f.Max <= 0 {
+				column.Type = "TEXT"
+			}
+		}
+		schema.Columns = append(schema.Columns, column)
+	}
+	return &schema
+}
+
+// insertOptions returns how the rows of the table are inserted.
+// The conflicts are resolved on the primary key of the schema or else on the unique field, if there is only one.
+func insertOptions(s *tableSeed) db.InsertOptions {
+	opts := db.InsertOptions{
+		CommitEvery: s.CommitEvery,
+		Conflict:    db.Conflict{Mode: s.OnConflict},
+		TargetRate:  s.RowsPerSecond,
+	}
+	if perThread := s.ThreadRowsPerSecond * float64(s.Threads); perThread > 0 && (opts.TargetRate == 0 || perThread < opts.TargetRate) {
+		opts.TargetRate = perThread
+	}
+	opts.Conflict.Keys = tableKey(s)
+	return opts
+}
+
+// tableKey returns the primary key of the schema or else the unique field, if there is only one
+func tableKey(s *tableSeed) []string {
+	if s.Schema != nil && len(s.Schema.PrimaryKey) > 0 {
+		return s.Schema.PrimaryKey
+	}
+	var key []string
+	for _, f := range s.Fields {
+		if f.Unique {
+			if len(key) > 0 {
+				return nil
+			}
+			key = []string{f.Field}
+		}
+	}
+	return key
 }
 
 // https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
 const allChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890_-/+?!@#$%^&*()[]"
 
-func randString(minLen int, maxLen int) string {
+func randString(r *rand.Rand, minLen int, maxLen int) string {
 	// inclusive
-	n := rand.Intn(maxLen-minLen+1) + minLen
+	n := r.Intn(maxLen-minLen+1) + minLen
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = allChars[rand.Int63()%int64(len(allChars))]
+		b[i] = allChars[r.Int63()%int64(len(allChars))]
 	}
 	return string(b)
 }
 
-// seedMap: table->[]map[field]any: string|int
-func genOneTable(seedMap *syncmap.Map, s *tableSeed) {
-	var records []map[string]any
-
-	slice, ok := seedMap.Load(s.Table)
-	if ok {
-		records = slice.([]map[string]any)
-	} else {
-		// first time for this table
-		records = make([]map[string]any, 0, s.Records)
-	}
-
-	unique := make(map[string]bool)
-	// for the number of records specified for this table
-	for i := 0; i < s.Records; i++ {
-		m := make(map[string]any)
-		// for each field
-		for _, f := range s.Fields {
-			if len(records) >= f.Cardinality {
-				// if the current record > cardinality, pick a random value already generated
-				m[f.Field] = records[rand.Intn(len(records))][f.Field]
-			} else {
-				// else, generate a new random value
-				switch f.FieldType {
-				case "string":
-					m[f.Field] = randString(f.Min, f.Max)
-					if f.Unique {
-						s := m[f.Field].(string)
-						//sooner or later we will hit a new one
-						for _, ok = unique[s]; ok; {
-							m[f.Field] = rand.Intn(f.Max-f.Min+1) + f.Min
-							s = m[f.Field].(string)
-						}
-						unique[s] = true
-					}
-				case "int":
-
-					m[f.Field] = rand.Intn(f.Max-f.Min+1) + f.Min
-					if f.Unique {
-						s := strconv.Itoa(m[f.Field].(int))
-						for _, ok = unique[s]; ok; {
-							m[f.Field] = rand.Intn(f.Max-f.Min+1) + f.Min
-							s = strconv.Itoa(m[f.Field].(int))
-						}
-						unique[s] = true
-					}
-				default:
-					log.Fatalf("Invalid %s field type: %s", f.Field, f.FieldType)
+// genTablePools generates the value pools of all fields of the table: field -> pool.
+// The referencing fields share the pool of the referenced field, so it must be generated before.
+func genTablePools(s *tableSeed, pools map[string]map[string]*valuePool, randomSeed int64) (map[string]*valuePool, error) {
+	if s.Source != nil {
+		return tablePoolsFromCSV(s, newRand(randomSeed, s.Table))
+	}
 
-				}
+	tablePools := make(map[string]*valuePool, len(s.Fields))
+	for i, f := range s.Fields {
+		if f.References != nil {
+			p, ok := pools[f.References.Table][f.References.Field]
+			if !ok {
+				return nil, fmt.Errorf("table %s field %s references %s.%s which is not seeded before it", s.Table, f.Field, f.References.Table, f.References.Field)
 			}
+			if f.Unique && p.size() < s.Records {
+				return nil, fmt.Errorf("table %s field %s needs %d unique values, %s.%s has %d", s.Table, f.Field, s.Records, f.References.Table, f.References.Field, p.size())
+			}
+			tablePools[f.Field] = p
+			continue
 		}
 
-		records = append(records, m)
+		p, err := genPool(&s.Fields[i], s.Records, newRand(randomSeed, s.Table, f.Field))
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", s.Table, err)
+		}
+		tablePools[f.Field] = p
 	}
+	return tablePools, nil
+}
 
-	seedMap.Store(s.Table, records)
+// rowSource feeds one insert thread with the rows [from, to) of the table, adding their values to counts if not nil
+func rowSource(s *tableSeed, pools map[string]*valuePool, from int, to int, r *rand.Rand, counts valueCounts) db.RowSource {
+	g := newRowGenerator(s, pools, from, r)
+	if counts != nil {
+		g.counts = make([][]int64, len(s.Fields))
+		for i, f := range s.Fields {
+			g.counts[i] = counts[f.Field]
+		}
+	}
+	return func() ([]any, bool) {
+		if g.row >= to {
+			return nil, false
+		}
+		return g.next(), true
+	}
 }
 
-func saveSQLSelect(config *config, dbSeeder dbseeder, seedMap *syncmap.Map, tableFieldTypes map[string]map[string]string) error {
+// countSeeded generates the rows a thread committed in a previous run again, only to count their values
+func countSeeded(s *tableSeed, pools map[string]*valuePool, thread int, th threadProgress, randomSeed int64, counts valueCounts) {
+	if counts == nil {
+		return
+	}
+	rows := rowSource(s, pools, th.From, th.From+th.Done, newRand(randomSeed, s.Table, strconv.Itoa(thread)), counts)
+	for _, ok := rows(); ok; _, ok = rows() {
+	}
+}
+
+func saveSQLSelect(config *config, dialect Dialect, pools map[string]map[string]*valuePool) error {
 	// generate tests
 	// the output file will look like
 	// threads = sql.Threads
 	// sql.Repeat sql.Statement statements with IN () lists built of previously generated random values
-	f, _ := os.Create(config.Stress.SaveSQLsToFile)
+	// JSON Lines for a .jsonl file, the text format otherwise
+	w, err := workload.Create(config.Stress.SaveSQLsToFile)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
 
-	for _, sql := range config.Stress.Sql {
-		if _, err := f.WriteString(stress.ID + strings.Join(strings.Fields(sql.ID), "+") + "\n"); err != nil {
+	g := newGenerator(config, newRenderer(config, dialect, pools, rand.New(rand.NewSource(rand.Int63()))))
+	if err := w.Header(g.MaxThreads()); err != nil {
+		return err
+	}
+	for {
+		rec, err := g.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
 			return err
 		}
-		if _, err := f.WriteString(stress.THREADS + strconv.Itoa(sql.Threads) + "\n"); err != nil {
+		if rec.Group != nil {
+			err = w.Group(*rec.Group)
+		} else {
+			err = w.Statement(*rec.Statement)
+		}
+		if err != nil {
 			return err
 		}
+	}
+}
 
-		jsonStrings := re.FindAllString(sql.Statement, -1)
-		defs := make([]whereListDef, len(jsonStrings))
+// renderPlaceholder renders one placeholder of a statement template per its kind
+func renderPlaceholder(def whereListDef,
+	pools map[string]map[string]*valuePool,
+	fresh func(table string, field string) (any, error),
+	r *rand.Rand,
+	literal func(any) string) (string, error) {
 
-		for i, sql := range jsonStrings {
-			if err := json.Unmarshal([]byte(sql), &defs[i]); err != nil {
-				return err
-			}
+	if def.MissRatio < 0 || def.MissRatio > 1 {
+		return "", fmt.Errorf("missRatio of %s.%s must be between 0 and 1", def.Table, def.Field)
+	}
+
+	switch def.Kind {
+	case "", placeholderIn:
+		return generateOneINList(def, pools, r, literal)
+	case placeholderLimit:
+		if def.Min < 1 || def.Max < def.Min || def.MaxOffset < 0 {
+			return "", fmt.Errorf("limit placeholder needs 1 <= min <= max and maxOffset >= 0")
+		}
+		token := literal(r.Intn(def.Max-def.Min+1) + def.Min)
+		if def.MaxOffset > 0 {
+			token += " OFFSET " + literal(r.Intn(def.MaxOffset+1))
+		}
+		return token, nil
+	case placeholderNew:
+		v, err := fresh(def.Table, def.Field)
+		if err != nil {
+			return "", err
 		}
+		return literal(v), nil
+	}
 
-		// build the list of queries
-		for i := 0; i < sql.Repeat; i++ {
-			tokens := make([]string, len(jsonStrings))
-			for j, def := range defs {
-				tokens[j] = generateOneINList(def, seedMap, tableFieldTypes)
-			}
-			if err := dbSeeder.WriteSQLSelect(f, sql.Statement, jsonStrings, tokens); err != nil {
-				return err
-			}
+	p, ok := pools[def.Table][def.Field]
+	if !ok || p.size() == 0 {
+		return "", fmt.Errorf("no seeded values for %s.%s", def.Table, def.Field)
+	}
+	pick := func() any {
+		return p.sample(r)
+	}
+
+	switch def.Kind {
+	case placeholderValue:
+		if r.Float64() < def.MissRatio {
+			return literal(p.missValue(r)), nil
+		}
+		return literal(pick()), nil
+	case placeholderBetween:
+		lo, hi := pick(), pick()
+		if lessValue(hi, lo) {
+			lo, hi = hi, lo
+		}
+		return literal(lo) + " AND " + literal(hi), nil
+	case placeholderLike:
+		if p.fieldType != "string" {
+			return "", fmt.Errorf("like placeholder of %s.%s needs a string field", def.Table, def.Field)
+		}
+		pattern, err := likePattern(def, pick().(string), r)
+		if err != nil {
+			return "", err
+		}
+		return literal(pattern), nil
+	}
+	return "", fmt.Errorf("unknown placeholder kind %s: in, value, between, like, limit or new", def.Kind)
+}
+
+// lessValue orders the bounds of a BETWEEN. The strings are compared byte by byte, which is the order
+// of the C and the binary collations only: the database does not tell the seed the collation of a column.
+func lessValue(a any, b any) bool {
+	if a, ok := a.(int); ok {
+		return a < b.(int)
+	}
+	return a.(string) < b.(string)
+}
 
+// the LIKE wildcards and the escape char of a seeded string match themselves as _
+var likeEscaper = strings.NewReplacer("%", "_", `\`, "_")
+
+// likePattern cuts a piece of minLen..maxLen chars off the seeded string, the half of it by default,
+// so the pattern matches the row the string came from
+func likePattern(def whereListDef, s string, r *rand.Rand) (string, error) {
+	n := max(len(s)/2, 1)
+	if def.MaxLen > 0 {
+		if def.MaxLen < def.MinLen {
+			return "", fmt.Errorf("like placeholder of %s.%s: maxLen is less than minLen", def.Table, def.Field)
 		}
+		n = r.Intn(def.MaxLen-def.MinLen+1) + def.MinLen
 	}
-	return nil
+	n = min(n, len(s))
+
+	switch def.Match {
+	case "", "prefix":
+		return likeEscaper.Replace(s[:n]) + "%", nil
+	case "suffix":
+		return "%" + likeEscaper.Replace(s[len(s)-n:]), nil
+	case "contains":
+		from := r.Intn(len(s) - n + 1)
+		return "%" + likeEscaper.Replace(s[from:from+n]) + "%", nil
+	}
+	return "", fmt.Errorf("unknown like match %s: prefix, suffix or contains", def.Match)
 }
 
 // whereListDef is from in ( {"table":"table_1", "field":"a", "minlen": 30, "maxlen": 100})
-func generateOneINList(def whereListDef, seedMap *syncmap.Map, tableFieldTypes map[string]map[string]string) string {
+func generateOneINList(def whereListDef, pools map[string]map[string]*valuePool, r *rand.Rand, literal func(any) string) (string, error) {
+	p, ok := pools[def.Table][def.Field]
+	if !ok {
+		return "", fmt.Errorf("no seeded values for %s.%s", def.Table, def.Field)
+	}
 
 	// get the IN list random length
-	l := rand.Intn(def.MaxLen-def.MinLen+1) + def.MinLen
-	// generate list picking l random elements from the values we generated
-	var sb strings.Builder
-	for i := 0; i < l; i++ {
-		lst, _ := seedMap.Load(def.Table)
-		lstTyped := lst.([]map[string]any)
-		idx := rand.Intn(len(lstTyped))
-		fieldType := tableFieldTypes[def.Table][def.Field]
-		if fieldType == "string" {
-			sb.WriteString(`"`)
-			value := lstTyped[idx][def.Field]
-			valueStr := value.(string)
-			sb.WriteString(valueStr)
-			sb.WriteString(`", `)
+	l := r.Intn(def.MaxLen-def.MinLen+1) + def.MinLen
+	// generate list picking l random elements from the values we generated,
+	// with the missRatio share of them swapped for the values that are not there
+	vals := make([]string, l)
+	for i := range vals {
+		if r.Float64() < def.MissRatio {
+			vals[i] = literal(p.missValue(r))
 			continue
 		}
-
-		value := lstTyped[idx][def.Field]
-		valueInt := value.(int)
-		sb.WriteString(strconv.Itoa(valueInt))
-		sb.WriteString(", ")
+		vals[i] = literal(p.sample(r))
 	}
-
-	token := sb.String()
-	return token[:len(token)-2]
+	return strings.Join(vals, ", "), nil
 }
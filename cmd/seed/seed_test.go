@@ -2,6 +2,7 @@ package seed
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,9 +12,12 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -21,7 +25,7 @@ import (
 )
 
 type mockDB struct {
-	// just to use its WriteSQLSelect method
+	// just to use its RenderSQLSelect method
 	d *db.Database
 }
 
@@ -29,13 +33,23 @@ func (db *mockDB) SeedTable(cc *cli.Context,
 	threadID string,
 	table string,
 	fields []string,
-	fieldValues []map[string]any,
+	rows db.RowSource,
+	opts db.InsertOptions,
 	statsChan chan stats.OneStatement,
 	wg *sync.WaitGroup) {
 
 	defer wg.Done()
-	slog.Debug("test seeding table", "threadID", threadID, "sql", "test-sql with"+strings.Join(fields, ","), "fieldValues", fieldValues)
-	for range fieldValues {
+	count := 0
+	for {
+		vals, ok := rows()
+		if !ok {
+			return
+		}
+		count++
+		if opts.Progress != nil {
+			opts.Progress(count)
+		}
+		slog.Debug("test seeding table", "threadID", threadID, "sql", "test-sql with"+strings.Join(fields, ","), "values", vals)
 		statsChan <- stats.OneStatement{
 			ID:       "insert-in-table" + table,
 			ThreadID: threadID,
@@ -48,19 +62,36 @@ func (db *mockDB) SeedTable(cc *cli.Context,
 	}
 }
 
-func (db *mockDB) WriteSQLSelect(f *os.File, sqlStatement string, jsonStrings []string, tokens []string) error {
+func (db *mockDB) RenderSQLSelect(sqlStatement string, jsonStrings []string, tokens []string) (string, error) {
 
 	for i, js := range jsonStrings {
 		var def whereListDef
 		json.Unmarshal([]byte(js), &def)
+		if def.Kind != "" && def.Kind != placeholderIn {
+			continue
+		}
 		commasCount := strings.Count(tokens[i], ",")
 		if commasCount+1 < def.MinLen || commasCount+1 > def.MaxLen {
-			return fmt.Errorf("wrong where list size %d", commasCount+1)
+			return "", fmt.Errorf("wrong where list size %d", commasCount+1)
 		}
 	}
 
-	db.d.WriteSQLSelect(f, sqlStatement, jsonStrings, tokens)
+	return db.d.RenderSQLSelect(sqlStatement, jsonStrings, tokens)
+}
+
+func (db *mockDB) Literal(v any) string {
+	return db.d.Literal(v)
+}
+
+func (db *mockDB) BindVar(i int) string {
+	return db.d.BindVar(i)
+}
 
+func (db *mockDB) PrepareTable(cc *cli.Context, table string, schema *db.TableSchema, opts db.SchemaOptions) error {
+	return nil
+}
+
+func (db *mockDB) CreateIndexes(cc *cli.Context, table string, schema *db.TableSchema, statsChan chan stats.OneStatement) error {
 	return nil
 }
 
@@ -87,6 +118,7 @@ func mockCLIConetext() *cli.Context {
 	fs.String(fl.Name, "", "")
 	// set a new value
 	fs.Set(fl.Name, outDir())
+	fs.String("output", "", "")
 
 	cc := cli.NewContext(app, fs, nil)
 	cc.Command.Name = "test"
@@ -226,6 +258,47 @@ func Test_doSeed(t *testing.T) {
 	}
 }
 
+func Test_genPool(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name     string
+		field    fieldSeed
+		records  int
+		wantSize int
+		wantErr  bool
+	}{
+		{"cardinality", fieldSeed{Field: "a", FieldType: "int", Min: 1, Max: 1000, Cardinality: 50}, 1000, 50, false},
+		{"interval smaller than cardinality", fieldSeed{Field: "a", FieldType: "int", Min: 1, Max: 10, Cardinality: 50}, 1000, 10, false},
+		{"unique", fieldSeed{Field: "a", FieldType: "int", Min: 1, Max: 5000, Unique: true}, 1000, 1000, false},
+		{"unique string", fieldSeed{Field: "b", FieldType: "string", Min: 2, Max: 5, Unique: true}, 1000, 1000, false},
+		{"unique does not fit", fieldSeed{Field: "a", FieldType: "int", Min: 1, Max: 10, Unique: true}, 1000, 0, true},
+		{"strings fewer than cardinality", fieldSeed{Field: "b", FieldType: "string", Min: 1, Max: 1, Cardinality: 500}, 1000, len(allChars), false},
+		{"unique strings do not fit", fieldSeed{Field: "b", FieldType: "string", Min: 1, Max: 1, Unique: true}, 1000, 0, true},
+		{"bad type", fieldSeed{Field: "a", FieldType: "float"}, 10, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := genPool(&tt.field, tt.records, r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("genPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.size() != tt.wantSize {
+				t.Errorf("pool size %d, want %d", p.size(), tt.wantSize)
+			}
+			seen := make(map[any]bool, p.size())
+			for i := 0; i < p.size(); i++ {
+				if seen[p.value(i)] {
+					t.Errorf("duplicate value %v in the pool", p.value(i))
+				}
+				seen[p.value(i)] = true
+			}
+		})
+	}
+}
+
 func lineCounter(r io.Reader) (int, error) {
 	buf := make([]byte, 32*1024)
 	count := 0
@@ -244,3 +317,842 @@ func lineCounter(r io.Reader) (int, error) {
 		}
 	}
 }
+
+func Test_doInit(t *testing.T) {
+	infos := map[string]*db.TableInfo{
+		"orders": {
+			Table: "orders",
+			Columns: []db.ColumnInfo{
+				{Name: "id", Type: "integer", NotNull: true, PrimaryKey: true},
+				{Name: "customer_id", Type: "integer", NotNull: true, References: &db.ForeignKey{Table: "customers", Column: "id"}},
+				{Name: "note", Type: "character varying(100)", MaxLength: 100},
+				{Name: "created", Type: "timestamp"},
+			},
+		},
+		"customers": {
+			Table: "customers",
+			Columns: []db.ColumnInfo{
+				{Name: "id", Type: "int", NotNull: true, PrimaryKey: true},
+				{Name: "email", Type: "varchar(64)", MaxLength: 64, Unique: true},
+			},
+			Indexes: []db.Index{{Name: "customers_email_key", Columns: []string{"email"}, Unique: true}},
+		},
+	}
+	cfg, err := doInit(func(table string) (*db.TableInfo, error) {
+		info, ok := infos[table]
+		if !ok {
+			return nil, fmt.Errorf("table %s not found", table)
+		}
+		return info, nil
+	}, []string{"orders", "customers"}, 100, 2)
+	if err != nil {
+		t.Fatalf("doInit() error = %v", err)
+	}
+
+	if len(cfg.Seed) != 2 || cfg.Seed[0].Table != "customers" || cfg.Seed[1].Table != "orders" {
+		t.Fatalf("referenced table must be seeded first, got %+v", cfg.Seed)
+	}
+	customers, orders := cfg.Seed[0], cfg.Seed[1]
+	if !customers.Fields[0].Unique || !customers.Fields[1].Unique {
+		t.Errorf("primary key and unique columns must be unique fields: %+v", customers.Fields)
+	}
+	if len(orders.Fields) != 3 {
+		t.Fatalf("unsupported column must be skipped, got %+v", orders.Fields)
+	}
+	if ref := orders.Fields[1].References; ref == nil || ref.Table != "customers" || ref.Field != "id" {
+		t.Errorf("foreign key must become a reference, got %+v", ref)
+	}
+	if f := orders.Fields[2]; f.FieldType != "string" || f.Max != 100 {
+		t.Errorf("varchar column must be a string field of its max length, got %+v", f)
+	}
+	if len(orders.Schema.Columns) != 4 || !orders.Schema.Columns[1].NotNull || orders.Schema.PrimaryKey[0] != "id" {
+		t.Errorf("schema must copy the columns and the primary key, got %+v", orders.Schema)
+	}
+
+	if _, err := doInit(func(table string) (*db.TableInfo, error) {
+		return nil, fmt.Errorf("table %s not found", table)
+	}, []string{"nope"}, 100, 2); err == nil {
+		t.Errorf("expected an error for a missing table")
+	}
+}
+
+func Test_fieldFromColumn(t *testing.T) {
+	tests := []struct {
+		colType   string
+		wantType  string
+		wantMax   int
+		supported bool
+	}{
+		{"integer", "int", 2147483647, true},
+		{"int(11) unsigned", "int", 2147483647, true},
+		{"UNSIGNED BIG INT", "int", 2147483647, true},
+		{"smallint", "int", 32767, true},
+		{"tinyint(1)", "int", 127, true},
+		{"mediumint", "int", 8388607, true},
+		{"INT8", "int", 2147483647, true},
+		{"bigserial", "int", 2147483647, true},
+		{"character varying(100)", "string", 100, true},
+		{"interval", "", 0, false},
+		{"point", "", 0, false},
+		{"int4range", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.colType, func(t *testing.T) {
+			f, ok := fieldFromColumn(db.ColumnInfo{Name: "c", Type: tt.colType, MaxLength: 100})
+			if ok != tt.supported {
+				t.Fatalf("fieldFromColumn() supported = %v, want %v", ok, tt.supported)
+			}
+			if ok && (f.FieldType != tt.wantType || f.Max != tt.wantMax) {
+				t.Errorf("fieldFromColumn() = %s max %d, want %s max %d", f.FieldType, f.Max, tt.wantType, tt.wantMax)
+			}
+		})
+	}
+}
+
+func Test_applyProfile(t *testing.T) {
+	table := tableSeed{
+		Table: "items",
+		Fields: []fieldSeed{
+			{Field: "id", FieldType: "int", Unique: true},
+			{Field: "color", FieldType: "string"},
+		},
+	}
+	p := &db.TableProfile{
+		Table: "items",
+		Rows:  1000,
+		Columns: map[string]*db.ColumnProfile{
+			"id": {Sampled: 1000, NonNull: 1000, Distinct: 1000, Min: 1, Max: 1000},
+			"color": {Sampled: 1000, NonNull: 800, Distinct: 20, MinLen: 3, MaxLen: 6,
+				Top: []db.ValueCount{{Value: "red", Count: 400}, {Value: "blue", Count: 30}}},
+		},
+	}
+	applyProfile(&table, p, 0)
+
+	if table.Records != 1000 {
+		t.Errorf("records must default to the profiled rows, got %d", table.Records)
+	}
+	if id := table.Fields[0]; id.Min != 1 || id.Max != 1000 || id.NullRatio != 0 || len(id.Enum) != 0 {
+		t.Errorf("unique field must only get min and max, got %+v", id)
+	}
+	color := table.Fields[1]
+	if color.NullRatio != 0.2 || color.Cardinality != 20 || color.Min != 3 || color.Max != 6 {
+		t.Errorf("wrong color field settings %+v", color)
+	}
+	if len(color.Enum) != 1 || color.Enum[0].Value != "red" || color.Enum[0].Weight != 0.5 {
+		t.Errorf("only the frequent value must go to the enum, got %+v", color.Enum)
+	}
+
+	// and the generator follows the enum weight and the NULL share
+	pools, err := genTablePools(&table, nil, 1)
+	if err != nil {
+		t.Fatalf("genTablePools() error = %v", err)
+	}
+	g := newRowGenerator(&table, pools, 0, rand.New(rand.NewSource(1)))
+	nulls, reds := 0, 0
+	for i := 0; i < table.Records; i++ {
+		switch g.next()[1] {
+		case nil:
+			nulls++
+		case "red":
+			reds++
+		}
+	}
+	if nulls < 150 || nulls > 250 || reds < 330 || reds > 470 {
+		t.Errorf("expected about 200 NULLs and 400 reds, got %d and %d", nulls, reds)
+	}
+}
+
+func Test_poolFromSource(t *testing.T) {
+	dir := t.TempDir()
+	lines := filepath.Join(dir, "skus.txt")
+	os.WriteFile(lines, []byte("10\n20\n30\n20\n\n40\n"), 0644)
+	csvFile := filepath.Join(dir, "cities.csv")
+	os.WriteFile(csvFile, []byte("id,name\n1,Paris\n2,Rome\n3,Paris\n"), 0644)
+
+	r := rand.New(rand.NewSource(1))
+	p, err := genPool(&fieldSeed{Field: "sku", FieldType: "int", Cardinality: 3, Source: &valueSource{File: lines}}, 100, r)
+	if err != nil || p.size() != 3 {
+		t.Fatalf("expected 3 of the 4 distinct values, got %v %v", p, err)
+	}
+	p, err = genPool(&fieldSeed{Field: "name", FieldType: "string", Source: &valueSource{File: csvFile, Column: "name"}}, 100, r)
+	if err != nil || p.size() != 2 {
+		t.Fatalf("expected the 2 distinct names, got %v %v", p, err)
+	}
+	if _, err = genPool(&fieldSeed{Field: "sku", FieldType: "int", Unique: true, Source: &valueSource{File: lines}}, 10, r); err == nil {
+		t.Errorf("expected an error: 10 unique values can't come from 4")
+	}
+	if _, err = genPool(&fieldSeed{Field: "name", FieldType: "int", Source: &valueSource{File: csvFile, Column: "name"}}, 10, r); err == nil {
+		t.Errorf("expected an error: names are not ints")
+	}
+}
+
+func Test_csvTableSource(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,grp\n")
+	for i := 0; i < 2*csvOffsetEvery+5; i++ {
+		fmt.Fprintf(&b, "%d,g%d\n", i+1, i%50)
+	}
+	file := filepath.Join(t.TempDir(), "rows.csv")
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &tableSeed{Table: "t", Source: &tableSource{File: file}, Fields: []fieldSeed{
+		{Field: "id", FieldType: "int", Unique: true},
+		{Field: "grp", FieldType: "string", Cardinality: 5},
+	}}
+	pools, err := tablePoolsFromCSV(s, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Records != 2*csvOffsetEvery+5 || pools["id"].size() != s.Records || pools["grp"].size() != 5 {
+		t.Fatalf("got %d records, %d ids, %d groups", s.Records, pools["id"].size(), pools["grp"].size())
+	}
+
+	// the thread seeks past the rows of the threads before it
+	from := 2*csvOffsetEvery + 1
+	rows, err := csvRowSource(s, from, from+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := from + 1; ; want++ {
+		row, ok := rows()
+		if !ok {
+			if want != from+4 {
+				t.Errorf("got the rows up to id %d, want up to %d", want-1, from+3)
+			}
+			break
+		}
+		if row[0] != want || row[1] != fmt.Sprintf("g%d", (want-1)%50) {
+			t.Fatalf("got row %v, want id %d", row, want)
+		}
+	}
+}
+
+func Test_doSeedToFiles(t *testing.T) {
+	sink, err := db.NewFileSink(outDir(), "csv", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{
+		Seed: []tableSeed{{
+			Table:   "Table_csv",
+			Records: 100,
+			Threads: 3,
+			Fields: []fieldSeed{
+				{Field: "id", FieldType: "int", Unique: true, Min: 1, Max: 1000},
+				{Field: "name", FieldType: "string", Min: 5, Max: 10, Cardinality: 7, NullRatio: 0.2},
+			},
+		}},
+		Stress: stressConfig{SaveSQLsToFile: filepath.Join(outDir(), "test-csv-sqls.sql")},
+	}
+	// the files have no checkpoint, they can't be resumed
+	os.Remove(checkpointPath(outDir()))
+	cc := mockCLIConetext()
+	cc.Set("output", "csv")
+	err = doSeed(cc, func(dbType string, dbUrl string) dbseeder { return sink }, cfg)
+	if err != nil {
+		t.Fatalf("doSeed() error = %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpointPath(outDir())); !os.IsNotExist(err) {
+		t.Errorf("a checkpoint written for the files: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(outDir(), "Table_csv.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 101 || recs[0][0] != "id" || recs[0][1] != "name" {
+		t.Fatalf("expected the header and 100 rows, got %d records starting with %v", len(recs), recs[0])
+	}
+	ids := make(map[string]bool)
+	for _, rec := range recs[1:] {
+		ids[rec[0]] = true
+	}
+	if len(ids) != 100 {
+		t.Errorf("unique field must have 100 distinct values, got %d", len(ids))
+	}
+}
+
+func Test_insertOptions(t *testing.T) {
+	s := tableSeed{
+		Table:      "t",
+		OnConflict: db.ConflictUpdate,
+		Fields:     []fieldSeed{{Field: "id", Unique: true}, {Field: "name"}},
+	}
+	if keys := insertOptions(&s).Conflict.Keys; len(keys) != 1 || keys[0] != "id" {
+		t.Errorf("the only unique field must be the conflict key, got %v", keys)
+	}
+
+	s.Schema = &db.TableSchema{PrimaryKey: []string{"name"}}
+	if keys := insertOptions(&s).Conflict.Keys; len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("the primary key must be the conflict key, got %v", keys)
+	}
+
+	s.Schema = nil
+	s.Fields[1].Unique = true
+	c := insertOptions(&s).Conflict
+	if len(c.Keys) != 0 {
+		t.Errorf("no conflict key expected for two unique fields, got %v", c.Keys)
+	}
+	if c.Validate("postgres") == nil || c.Validate("mysql") != nil {
+		t.Errorf("only postgres needs the conflict key to update")
+	}
+
+	s.Threads, s.RowsPerSecond, s.ThreadRowsPerSecond = 4, 1000, 100
+	if rate := insertOptions(&s).TargetRate; rate != 400 {
+		t.Errorf("target rate must be the lower of the table and the threads total, got %f", rate)
+	}
+}
+
+// recordingDB keeps the inserted rows, failing each thread after failAfter rows if it is set
+type recordingDB struct {
+	*mockDB
+	mu        sync.Mutex
+	rows      []string
+	failAfter int
+}
+
+func (db *recordingDB) SeedTable(cc *cli.Context,
+	threadID string,
+	table string,
+	fields []string,
+	rows db.RowSource,
+	opts db.InsertOptions,
+	statsChan chan stats.OneStatement,
+	wg *sync.WaitGroup) {
+
+	defer wg.Done()
+	for count := 0; db.failAfter == 0 || count < db.failAfter; {
+		vals, ok := rows()
+		if !ok {
+			return
+		}
+		db.mu.Lock()
+		db.rows = append(db.rows, table+fmt.Sprint(vals...))
+		db.mu.Unlock()
+		count++
+		opts.Progress(count)
+	}
+}
+
+func resumeCLIContext(dir string, resume bool) *cli.Context {
+	fs := flag.NewFlagSet("", flag.ExitOnError)
+	fs.String("out-dir", dir, "")
+	fs.Int64("random-seed", 42, "")
+	fs.Bool("resume", resume, "")
+	cc := cli.NewContext(cli.NewApp(), fs, nil)
+	cc.Command.Name = "test"
+	return cc
+}
+
+func Test_checkpointProgress(t *testing.T) {
+	dir := t.TempDir()
+	cp := newCheckpoint(dir, 42)
+	s := &tableSeed{Table: "t", Records: 100}
+	if _, err := cp.startTable(s, [][2]int{{0, 50}, {50, 100}}); err != nil {
+		t.Fatal(err)
+	}
+	written := func() int {
+		t.Helper()
+		loaded, err := loadCheckpoint(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loaded.Tables["t"].Threads[0].Done
+	}
+
+	// the autocommit inserts right after a write wait for the next one
+	for done := 1; done <= 10; done++ {
+		if err := cp.progress("t", 0, done, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := written(); n != 0 {
+		t.Errorf("checkpoint has %d rows done, want the 0 of the last write", n)
+	}
+	if err := cp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := written(); n != 10 {
+		t.Errorf("flushed checkpoint has %d rows done, want 10", n)
+	}
+	// a commit is written at once
+	if err := cp.progress("t", 0, 20, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := written(); n != 20 {
+		t.Errorf("checkpoint has %d rows done after a commit, want 20", n)
+	}
+}
+
+func Test_resume(t *testing.T) {
+	fields := []fieldSeed{
+		{Field: "id", FieldType: "int", Unique: true, Min: 1, Max: 100000},
+		{Field: "name", FieldType: "string", Min: 5, Max: 10, Cardinality: 20, NullRatio: 0.1},
+	}
+	cfg := config{
+		// the small table is done before the failure, the resume skips it
+		Seed: []tableSeed{
+			{Table: "Table_done", Records: 60, Threads: 3, Fields: fields},
+			{Table: "Table_resume", Records: 300, Threads: 3, Fields: fields},
+		},
+		Stress: stressConfig{SaveSQLsToFile: filepath.Join(t.TempDir(), "sqls.sql")},
+	}
+	seed := func(dir string, resume bool, d *recordingDB) map[string]map[string]*valuePool {
+		cfg.Stress.SavePoolsToFile = filepath.Join(dir, "pools.gob.gz")
+		err := doSeed(resumeCLIContext(dir, resume), func(dbType string, dbUrl string) dbseeder { return d }, cfg)
+		if (err != nil) != (d.failAfter > 0) {
+			t.Fatalf("doSeed() error = %v, the threads fail after %d rows", err, d.failAfter)
+		}
+		if err != nil {
+			return nil
+		}
+		pools, err := loadPools(cfg.Stress.SavePoolsToFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pools
+	}
+
+	whole := &recordingDB{mockDB: &mockDB{d: db.New("postgres", "fake-db-url")}}
+	wholePools := seed(t.TempDir(), false, whole)
+
+	dir := t.TempDir()
+	interrupted := &recordingDB{mockDB: whole.mockDB, failAfter: 30}
+	seed(dir, false, interrupted)
+	if len(interrupted.rows) != 60+90 {
+		t.Fatalf("expected 150 rows before the failure, got %d", len(interrupted.rows))
+	}
+	resumed := &recordingDB{mockDB: whole.mockDB}
+	resumedPools := seed(dir, true, resumed)
+
+	got := append(interrupted.rows, resumed.rows...)
+	sort.Strings(got)
+	sort.Strings(whole.rows)
+	if strings.Join(got, "\n") != strings.Join(whole.rows, "\n") {
+		t.Errorf("interrupted and resumed run must insert the rows of the whole run, got %d rows, want %d", len(got), len(whole.rows))
+	}
+
+	cp, err := loadCheckpoint(dir)
+	if err != nil || !cp.Tables["Table_resume"].Done {
+		t.Errorf("resumed table must be done in the checkpoint, got %+v %v", cp, err)
+	}
+	// the rows of the previous run count as well, so the stress draws the values the rows have
+	for _, table := range []string{"Table_done", "Table_resume"} {
+		if got, want := resumedPools[table]["name"].counts, wholePools[table]["name"].counts; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: resumed run counted %v, the whole run %v", table, got, want)
+		}
+	}
+}
+
+func Test_saveSQLSelectGroupSettings(t *testing.T) {
+	path := filepath.Join(outDir(), "session-init-sqls.txt")
+	config := config{
+		SessionInit: []string{"SET work_mem = '64MB'"},
+		Stress: stressConfig{
+			SaveSQLsToFile: path,
+			Sql: []sql{
+				{ID: "with init", Statement: "SELECT 1", Repeat: 1, Threads: 2, SessionInit: []string{"SET search_path = a, b"}},
+				{ID: "global", Statement: "SELECT 2", Repeat: 1, Threads: 1, Timeout: "2s"},
+			},
+		},
+	}
+	if err := saveSQLSelect(&config, &mockDB{d: db.New("postgres", "")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `MAX_THREADS = 2
+ID = with+init
+THREADS = 2
+SESSION = SET work_mem = '64MB'
+SESSION = SET search_path = a, b
+SELECT 1
+ID = global
+THREADS = 1
+SESSION = SET work_mem = '64MB'
+TIMEOUT = 2s
+SELECT 2
+`
+	if string(b) != want {
+		t.Errorf("sqls file\n%s\nwant\n%s", b, want)
+	}
+}
+
+func Test_renderPlaceholder(t *testing.T) {
+	pools := map[string]map[string]*valuePool{
+		"t": {
+			"n": {fieldType: "int", ints: []int{3, 7, 11}},
+			"s": {fieldType: "string", strings: []string{"ab%cd'ef"}},
+		},
+	}
+	config := config{Seed: []tableSeed{{Table: "t", Fields: []fieldSeed{
+		{Field: "n", FieldType: "int", Unique: true},
+		{Field: "s", FieldType: "string", Min: 4, Max: 4},
+	}}}}
+	r := rand.New(rand.NewSource(1))
+	fresh := newRenderer(&config, &mockDB{d: db.New("postgres", "")}, pools, r).freshValue
+	literal := db.New("postgres", "").Literal
+
+	tests := []struct {
+		name    string
+		def     whereListDef
+		check   func(string) bool
+		wantErr bool
+	}{
+		{"in", whereListDef{Table: "t", Field: "s", MinLen: 2, MaxLen: 2},
+			func(s string) bool { return s == `'ab%cd''ef', 'ab%cd''ef'` }, false},
+		{"value", whereListDef{Kind: "value", Table: "t", Field: "n"},
+			func(s string) bool { return s == "3" || s == "7" || s == "11" }, false},
+		{"between", whereListDef{Kind: "between", Table: "t", Field: "n"},
+			func(s string) bool {
+				var lo, hi int
+				_, err := fmt.Sscanf(s, "%d AND %d", &lo, &hi)
+				return err == nil && lo <= hi
+			}, false},
+		{"like prefix", whereListDef{Kind: "like", Table: "t", Field: "s", MinLen: 3, MaxLen: 3},
+			func(s string) bool { return s == "'ab_%'" }, false},
+		{"like suffix", whereListDef{Kind: "like", Table: "t", Field: "s", Match: "suffix", MinLen: 4, MaxLen: 4},
+			func(s string) bool { return s == "'%d''ef'" }, false},
+		{"limit", whereListDef{Kind: "limit", Min: 5, Max: 5, MaxOffset: 0},
+			func(s string) bool { return s == "5" }, false},
+		{"limit offset", whereListDef{Kind: "limit", Min: 1, Max: 10, MaxOffset: 100},
+			func(s string) bool { return strings.Contains(s, " OFFSET ") }, false},
+		// a unique field gets a value no row has, the others one of the pool
+		{"new unique", whereListDef{Kind: "new", Table: "t", Field: "n"},
+			func(s string) bool { return s == "12" }, false},
+		{"new", whereListDef{Kind: "new", Table: "t", Field: "s"},
+			func(s string) bool { return s == `'ab%cd''ef'` }, false},
+		{"like of int", whereListDef{Kind: "like", Table: "t", Field: "n"}, nil, true},
+		{"no seed", whereListDef{Kind: "new", Table: "t", Field: "x"}, nil, true},
+		{"no seed table", whereListDef{Kind: "new", Table: "u", Field: "n"}, nil, true},
+		{"unknown kind", whereListDef{Kind: "regexp", Table: "t", Field: "n"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderPlaceholder(tt.def, pools, fresh, r, literal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderPlaceholder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(got) {
+				t.Errorf("renderPlaceholder() = %s", got)
+			}
+		})
+	}
+}
+
+func Test_missValue(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pools := []*valuePool{
+		{fieldType: "int", ints: distinctInts(50, 1, 100, r)},
+		{fieldType: "string", strings: distinctStrings(len(allChars), 1, 1, r)}, // all the one char strings are taken
+	}
+	for _, p := range pools {
+		in := make(map[any]bool, p.size())
+		for i := 0; i < p.size(); i++ {
+			in[p.value(i)] = true
+		}
+		for i := 0; i < 1000; i++ {
+			if v := p.missValue(r); in[v] {
+				t.Fatalf("missValue() = %v of the %s pool", v, p.fieldType)
+			}
+		}
+	}
+
+	// every value of the list is a miss
+	pool := map[string]map[string]*valuePool{"t": {"a": pools[0]}}
+	list, err := generateOneINList(whereListDef{Table: "t", Field: "a", MinLen: 20, MaxLen: 20, MissRatio: 1}, pool, r, db.New("postgres", "").Literal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range strings.Split(list, ", ") {
+		var v int
+		fmt.Sscan(s, &v)
+		if v >= 1 && v <= 100 {
+			t.Errorf("IN list value %d is within the seeded range", v)
+		}
+	}
+}
+
+func Test_saveSQLSelectBindArgs(t *testing.T) {
+	path := filepath.Join(outDir(), "bind-args-sqls.txt")
+	config := config{
+		Stress: stressConfig{
+			SaveSQLsToFile: path,
+			BindArgs:       true,
+			Sql: []sql{
+				{ID: "bind", Repeat: 1, Threads: 1,
+					Statement: `SELECT * FROM t WHERE a IN ({"table":"t", "field":"a", "minlen": 2, "maxlen": 2}) AND b = {"kind":"value", "table":"t", "field":"b"} LIMIT {"kind":"limit", "min": 5, "max": 5}`},
+			},
+		},
+	}
+	pools := map[string]map[string]*valuePool{
+		"t": {
+			"a": {fieldType: "int", ints: []int{7}},
+			"b": {fieldType: "string", strings: []string{"it's"}},
+		},
+	}
+	if err := saveSQLSelect(&config, &mockDB{d: db.New("postgres", "")}, pools); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `MAX_THREADS = 1
+ID = bind
+THREADS = 1
+ARGS = [7,7,"it's",5]
+SELECT * FROM t WHERE a IN ($1, $2) AND b = $3 LIMIT $4
+`
+	if string(b) != want {
+		t.Errorf("sqls file\n%s\nwant\n%s", b, want)
+	}
+}
+
+func Test_renderWrite(t *testing.T) {
+	config := config{Seed: []tableSeed{{
+		Table: "t",
+		Fields: []fieldSeed{
+			{Field: "a", FieldType: "int", Unique: true},
+			{Field: "b", FieldType: "string"},
+		},
+	}}}
+	pools := map[string]map[string]*valuePool{
+		"t": {
+			"a": {fieldType: "int", ints: []int{3, 7, 11}},
+			"b": {fieldType: "string", strings: []string{"it's"}},
+		},
+	}
+	rd := newRenderer(&config, &mockDB{d: db.New("postgres", "")}, pools, rand.New(rand.NewSource(1)))
+
+	tests := []struct {
+		name    string
+		w       writeDef
+		want    []string
+		wantErr bool
+	}{
+		{"insert", writeDef{Op: "insert", Table: "t"},
+			[]string{"INSERT INTO t (a,b) VALUES (12,'it''s')", "INSERT INTO t (a,b) VALUES (13,'it''s')"}, false},
+		{"update", writeDef{Op: "update", Table: "t"},
+			[]string{"UPDATE t SET b = 'it''s' WHERE a = "}, false},
+		{"update set", writeDef{Op: "update", Table: "t", Key: []string{"b"}, Set: []string{"a"}},
+			[]string{"UPDATE t SET a = 15 WHERE b = 'it''s'"}, false},
+		{"delete", writeDef{Op: "delete", Table: "t"},
+			[]string{"DELETE FROM t WHERE a = "}, false},
+		{"unknown field", writeDef{Op: "update", Table: "t", Set: []string{"c"}}, nil, true},
+		{"unknown table", writeDef{Op: "delete", Table: "u"}, nil, true},
+		{"unknown op", writeDef{Op: "upsert", Table: "t"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, want := range tt.want {
+				st, err := rd.renderWrite(&tt.w)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(st.SQL, want) {
+					t.Errorf("renderWrite() = %s, want %s", st.SQL, want)
+				}
+			}
+			if tt.wantErr {
+				if _, err := rd.renderWrite(&tt.w); err == nil {
+					t.Error("renderWrite() is no error")
+				}
+			}
+		})
+	}
+
+	// the values of a key of several fields come from one row
+	keyed := config
+	keyed.Seed = append(keyed.Seed, tableSeed{Table: "k", Records: 3, Fields: []fieldSeed{
+		{Field: "x", FieldType: "int", Unique: true},
+		{Field: "y", FieldType: "string", Unique: true},
+		{Field: "z", FieldType: "int"},
+	}})
+	pools["k"] = map[string]*valuePool{
+		"x": {fieldType: "int", ints: []int{1, 2, 3, 4}},
+		"y": {fieldType: "string", strings: []string{"one", "two", "three", "four"}},
+		"z": {fieldType: "int", ints: []int{5}},
+	}
+	rd = newRenderer(&keyed, &mockDB{d: db.New("postgres", "")}, pools, rand.New(rand.NewSource(1)))
+	rows := map[string]bool{
+		"DELETE FROM k WHERE x = 1 AND y = 'one'":   true,
+		"DELETE FROM k WHERE x = 2 AND y = 'two'":   true,
+		"DELETE FROM k WHERE x = 3 AND y = 'three'": true,
+	}
+	for i := 0; i < 20; i++ {
+		st, err := rd.renderWrite(&writeDef{Op: "delete", Table: "k", Key: []string{"x", "y"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rows[st.SQL] {
+			t.Fatalf("renderWrite() = %s, the key is of no seeded row", st.SQL)
+		}
+	}
+	if _, err := rd.renderWrite(&writeDef{Op: "delete", Table: "k", Key: []string{"x", "z"}}); err == nil {
+		t.Error("renderWrite() of a key of several fields with a non unique one is no error")
+	}
+
+	// no key to default to
+	config.Seed[0].Fields[0].Unique = false
+	rd = newRenderer(&config, &mockDB{d: db.New("postgres", "")}, pools, rand.New(rand.NewSource(1)))
+	if _, err := rd.renderWrite(&writeDef{Op: "delete", Table: "t"}); err == nil {
+		t.Error("renderWrite() of a delete without a key is no error")
+	}
+}
+
+func Test_Generator(t *testing.T) {
+	dir := t.TempDir()
+	poolsPath := filepath.Join(dir, "pools.gob.gz")
+	pools := map[string]map[string]*valuePool{
+		"t": {
+			"a": {fieldType: "int", ints: []int{3, 7, 11}},
+			"b": {fieldType: "string", strings: []string{"it's"}},
+		},
+	}
+	if err := savePools(poolsPath, pools); err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(dir, "config.json")
+	cfg := `{"seed": [{"table": "t", "records": 3, "insertThreads": 1, "fields": [
+		{"field": "a", "field_type": "int", "unique": true}, {"field": "b", "field_type": "string"}]}],
+	"stressConfig": {"pools_to_file": "` + poolsPath + `", "sql": [
+		{"ID": "q", "repeat": 3, "threads": 2, "statement": "SELECT * FROM t WHERE a IN ({\"table\":\"t\", \"field\":\"a\", \"minLen\": 1, \"maxLen\": 1}) AND b = {\"kind\":\"value\", \"table\":\"t\", \"field\":\"b\"}"},
+		{"ID": "w", "repeat": 1, "threads": 4, "write": {"op": "delete", "table": "t", "key": ["b"]}}
+	]}}`
+	if err := os.WriteFile(configPath, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGenerator(configPath, poolsPath, db.New("postgres", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.MaxThreads(); n != 4 {
+		t.Errorf("MaxThreads() = %d, want 4", n)
+	}
+	var got []string
+	for {
+		rec, err := g.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Group != nil {
+			got = append(got, "group "+rec.Group.ID)
+			continue
+		}
+		got = append(got, rec.Statement.SQL)
+	}
+
+	want := []string{"group q", "", "", "", "group w", "DELETE FROM t WHERE b = 'it''s'"}
+	if len(got) != len(want) {
+		t.Fatalf("Next() = %q, want %d records", got, len(want))
+	}
+	for i, s := range got {
+		if i >= 1 && i <= 3 {
+			if !strings.HasPrefix(s, "SELECT * FROM t WHERE a IN (") || !strings.HasSuffix(s, ") AND b = 'it''s'") {
+				t.Errorf("statement %d = %s", i, s)
+			}
+			continue
+		}
+		if s != want[i] {
+			t.Errorf("record %d = %s, want %s", i, s, want[i])
+		}
+	}
+}
+
+func Test_valueCounts(t *testing.T) {
+	table := tableSeed{
+		Table:   "t",
+		Records: 1000,
+		Fields: []fieldSeed{
+			{Field: "id", FieldType: "int", Unique: true, Min: 1, Max: 100000},
+			{Field: "color", FieldType: "string", Min: 3, Max: 6, Cardinality: 5, NullRatio: 0.1,
+				Enum: []enumValue{{Value: "red", Weight: 0.9}}},
+		},
+	}
+	pools, err := genTablePools(&table, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := newValueCounts(&table, pools)
+	if _, ok := counts["id"]; ok {
+		t.Error("the values of a unique field are counted")
+	}
+	rows := rowSource(&table, pools, 0, table.Records, rand.New(rand.NewSource(1)), counts)
+	nonNull := 0
+	for row, ok := rows(); ok; row, ok = rows() {
+		if row[1] != nil {
+			nonNull++
+		}
+	}
+	total := int64(0)
+	for _, c := range counts["color"] {
+		total += c
+	}
+	if total != int64(nonNull) {
+		t.Errorf("counted %d values of %d non NULL rows", total, nonNull)
+	}
+
+	// the stress SQLs draw red as often as the rows have it
+	counted := countedPools(map[string]map[string]*valuePool{"t": pools}, map[string]valueCounts{"t": counts})
+	if counted["t"]["id"] != pools["id"] {
+		t.Error("the pool of an uncounted field is copied")
+	}
+	r := rand.New(rand.NewSource(1))
+	reds := 0
+	for i := 0; i < 1000; i++ {
+		if counted["t"]["color"].sample(r) == "red" {
+			reds++
+		}
+	}
+	if reds < 850 || reds > 950 {
+		t.Errorf("drew red %d times of 1000, want about 900", reds)
+	}
+}
+
+func Test_samplePools(t *testing.T) {
+	config := config{Seed: []tableSeed{{
+		Table: "t",
+		Fields: []fieldSeed{
+			{Field: "a", FieldType: "int"},
+			{Field: "b", FieldType: "string"},
+		},
+	}}}
+	pools, err := samplePools(&config, func(table string, field string, isString bool) ([]db.ValueCount, error) {
+		if isString {
+			return []db.ValueCount{{Value: "x", Count: 0}, {Value: "y", Count: 3}}, nil
+		}
+		return []db.ValueCount{{Value: 7, Count: 2}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := pools["t"]["a"]; !reflect.DeepEqual(a.ints, []int{7}) || !reflect.DeepEqual(a.counts, []int64{2}) {
+		t.Errorf("pool of a = %+v", a)
+	}
+	b := pools["t"]["b"]
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if v := b.sample(r); v != "y" {
+			t.Fatalf("sample() = %v of a value no row has", v)
+		}
+	}
+}
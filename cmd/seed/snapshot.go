@@ -0,0 +1,89 @@
+package seed
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// poolSnapshot is the value pools of a seed run with the rows per value, all the stress needs to render the SQLs of the config itself.
+// It is gob encoded and gzipped: the pools are the distinct values only, far smaller than the rendered SQLs.
+type poolSnapshot struct {
+	Tables map[string]map[string]snapshotPool
+}
+
+type snapshotPool struct {
+	FieldType string
+	Ints      []int
+	Strings   []string
+	Counts    []int64 // nil if not counted
+}
+
+func savePools(path string, pools map[string]map[string]*valuePool) error {
+	snap := poolSnapshot{Tables: make(map[string]map[string]snapshotPool, len(pools))}
+	for table, fields := range pools {
+		snap.Tables[table] = make(map[string]snapshotPool, len(fields))
+		for field, p := range fields {
+			snap.Tables[table][field] = snapshotPool{FieldType: p.fieldType, Ints: p.ints, Strings: p.strings, Counts: p.counts}
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	if err := gob.NewEncoder(gz).Encode(&snap); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write pools to %s: %w", path, err)
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadPools(path string) (map[string]map[string]*valuePool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pools from %s: %w", path, err)
+	}
+	var snap poolSnapshot
+	if err := gob.NewDecoder(gz).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("failed to read pools from %s: %w", path, err)
+	}
+
+	pools := make(map[string]map[string]*valuePool, len(snap.Tables))
+	for table, fields := range snap.Tables {
+		pools[table] = make(map[string]*valuePool, len(fields))
+		for field, p := range fields {
+			pools[table][field] = &valuePool{fieldType: p.FieldType, ints: p.Ints, strings: p.Strings, counts: p.Counts}
+		}
+	}
+	return pools, nil
+}
+
+// countedPools returns the pools with the rows counted per value of each table field.
+// A field referencing the pool of another one gets a copy with its own counts.
+func countedPools(pools map[string]map[string]*valuePool, counts map[string]valueCounts) map[string]map[string]*valuePool {
+	counted := make(map[string]map[string]*valuePool, len(pools))
+	for table, fields := range pools {
+		counted[table] = make(map[string]*valuePool, len(fields))
+		for field, p := range fields {
+			c, ok := counts[table][field]
+			if !ok {
+				counted[table][field] = p
+				continue
+			}
+			counted[table][field] = &valuePool{fieldType: p.fieldType, ints: p.ints, strings: p.strings, counts: c}
+		}
+	}
+	return counted
+}
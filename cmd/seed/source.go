@@ -0,0 +1,299 @@
+package seed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// valueSource is a file the values of a field are sampled from instead of generating them:
+// a .csv file with a header row, column being the header of the one to take,
+// or any other file with a value per line.
+type valueSource struct {
+	File   string `json:"file"`
+	Column string `json:"column,omitempty"`
+}
+
+// tableSource is a .csv file with a header row the whole rows of the table are loaded from.
+// Columns maps the fields to the CSV columns, a field not in the map is taken from the column of its own name.
+type tableSource struct {
+	File    string            `json:"file"`
+	Columns map[string]string `json:"columns,omitempty"`
+
+	// the byte offset of every csvOffsetEvery-th row, for the insert threads to seek to their rows
+	offsets []int64
+}
+
+// csvOffsetEvery is how many rows apart the offsets of the table source are kept
+const csvOffsetEvery = 10000
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// readSource returns the distinct values of the source in the file order
+func readSource(src *valueSource) ([]string, error) {
+	f, err := os.Open(src.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vals []string
+	seen := make(map[string]bool)
+	add := func(v string) {
+		if !seen[v] {
+			seen[v] = true
+			vals = append(vals, v)
+		}
+	}
+
+	if !isCSV(src.File) {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v := strings.TrimSpace(scanner.Text()); len(v) > 0 {
+				add(v)
+			}
+		}
+		return vals, scanner.Err()
+	}
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of %s: %w", src.File, err)
+	}
+	idx := indexOf(header, src.Column)
+	if idx < 0 {
+		return nil, fmt.Errorf("no column %s in %s", src.Column, src.File)
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec[idx]) > 0 {
+			add(rec[idx])
+		}
+	}
+}
+
+func indexOf(header []string, column string) int {
+	for i, h := range header {
+		if strings.TrimSpace(h) == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// poolFromSource samples n values of the field from its source file,
+// fewer if the file does not have that many unless the field is unique and needs a value per record
+func poolFromSource(f *fieldSeed, n int, r *rand.Rand) (*valuePool, error) {
+	vals, err := readSource(f.Source)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", f.Field, err)
+	}
+	if len(vals) < n {
+		if f.Unique {
+			return nil, fmt.Errorf("field %s: %d unique values needed, %s has %d", f.Field, n, f.Source.File, len(vals))
+		}
+		n = len(vals)
+	}
+	r.Shuffle(len(vals), func(i, j int) { vals[i], vals[j] = vals[j], vals[i] })
+	return typedPool(f.Field, f.FieldType, vals[:n])
+}
+
+func typedPool(field string, fieldType string, vals []string) (*valuePool, error) {
+	p := &valuePool{fieldType: fieldType}
+	switch fieldType {
+	case "int":
+		p.ints = make([]int, len(vals))
+		for i, v := range vals {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field, err)
+			}
+			p.ints[i] = n
+		}
+	case "string":
+		p.strings = vals
+	default:
+		return nil, fmt.Errorf("invalid %s field type: %s", field, fieldType)
+	}
+	return p, nil
+}
+
+// csvTable reads the table source: opens it and maps the fields to the CSV columns
+type csvTable struct {
+	f      *os.File
+	r      *csv.Reader
+	fields []fieldSeed
+	idx    []int
+}
+
+func openCSVTable(s *tableSeed) (*csvTable, error) {
+	f, err := os.Open(s.Source.File)
+	if err != nil {
+		return nil, err
+	}
+	t := &csvTable{f: f, r: csv.NewReader(f), fields: s.Fields, idx: make([]int, len(s.Fields))}
+	t.r.ReuseRecord = true
+
+	header, err := t.r.Read()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read the header of %s: %w", s.Source.File, err)
+	}
+	for i, field := range s.Fields {
+		column, ok := s.Source.Columns[field.Field]
+		if !ok {
+			column = field.Field
+		}
+		if t.idx[i] = indexOf(header, column); t.idx[i] < 0 {
+			f.Close()
+			return nil, fmt.Errorf("table %s: no column %s in %s", s.Table, column, s.Source.File)
+		}
+	}
+	return t, nil
+}
+
+// next returns the next row typed per the fields, empty CSV values are NULLs
+func (t *csvTable) next() ([]any, error) {
+	rec, err := t.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]any, len(t.fields))
+	for i, f := range t.fields {
+		v := rec[t.idx[i]]
+		if len(v) == 0 {
+			continue
+		}
+		if f.FieldType != "int" {
+			vals[i] = v
+			continue
+		}
+		if vals[i], err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Field, err)
+		}
+	}
+	return vals, nil
+}
+
+// seek goes on reading the rows at the offset, one of the offsets of the table source
+func (t *csvTable) seek(offset int64) error {
+	if _, err := t.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	t.r = csv.NewReader(t.f)
+	t.r.ReuseRecord = true
+	return nil
+}
+
+func (t *csvTable) close() {
+	t.f.Close()
+}
+
+// tablePoolsFromCSV reads the table source once to count the rows, capping the records by it,
+// to keep the offsets of its rows, and to collect the distinct values of each field for the IN lists.
+// A field with a cardinality stops collecting once it has that many, so only the pools are in memory, not the file.
+func tablePoolsFromCSV(s *tableSeed, r *rand.Rand) (map[string]*valuePool, error) {
+	t, err := openCSVTable(s)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+
+	distinct := make([]map[any]bool, len(s.Fields))
+	for i := range distinct {
+		distinct[i] = make(map[any]bool)
+	}
+	s.Source.offsets = nil
+	rows := 0
+	for {
+		if rows%csvOffsetEvery == 0 {
+			s.Source.offsets = append(s.Source.offsets, t.r.InputOffset())
+		}
+		vals, err := t.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("table %s row %d: %w", s.Table, rows+1, err)
+		}
+		for i, v := range vals {
+			if c := s.Fields[i].Cardinality; v != nil && (c <= 0 || len(distinct[i]) < c) {
+				distinct[i][v] = true
+			}
+		}
+		rows++
+	}
+	if s.Records <= 0 || s.Records > rows {
+		s.Records = rows
+	}
+
+	pools := make(map[string]*valuePool, len(s.Fields))
+	for i, f := range s.Fields {
+		vals := make([]string, 0, len(distinct[i]))
+		for v := range distinct[i] {
+			vals = append(vals, fmt.Sprint(v))
+		}
+		// map order is random, but not seeded by us
+		sort.Strings(vals)
+		r.Shuffle(len(vals), func(i, j int) { vals[i], vals[j] = vals[j], vals[i] })
+		if pools[f.Field], err = typedPool(f.Field, f.FieldType, vals); err != nil {
+			return nil, err
+		}
+	}
+	return pools, nil
+}
+
+// csvRowSource feeds one insert thread with the rows [from, to) of the table source,
+// seeking to the offset kept before from and skipping the rows up to it
+func csvRowSource(s *tableSeed, from int, to int) (db.RowSource, error) {
+	t, err := openCSVTable(s)
+	if err != nil {
+		return nil, err
+	}
+	skipped := 0
+	if k := min(from/csvOffsetEvery, len(s.Source.offsets)-1); k > 0 {
+		if err := t.seek(s.Source.offsets[k]); err != nil {
+			t.close()
+			return nil, fmt.Errorf("table %s: failed to seek to row %d: %w", s.Table, k*csvOffsetEvery, err)
+		}
+		skipped = k * csvOffsetEvery
+	}
+	for row := skipped; row < from; row++ {
+		if _, err := t.next(); err != nil {
+			t.close()
+			return nil, fmt.Errorf("table %s: failed to skip to row %d: %w", s.Table, from, err)
+		}
+	}
+
+	row := from
+	return func() ([]any, bool) {
+		if row >= to {
+			t.close()
+			return nil, false
+		}
+		vals, err := t.next()
+		if err != nil {
+			log.Fatalf("table %s: failed to read row %d of %s: %v", s.Table, row+1, s.Source.File, err)
+		}
+		row++
+		return vals, true
+	}, nil
+}
@@ -0,0 +1,228 @@
+package seed
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+)
+
+// template is a statement of the stress config with its placeholders parsed
+type template struct {
+	statement   string
+	jsonStrings []string
+	defs        []whereListDef
+}
+
+func parseTemplate(statement string) (*template, error) {
+	t := &template{statement: statement, jsonStrings: re.FindAllString(statement, -1)}
+	t.defs = make([]whereListDef, len(t.jsonStrings))
+	for i, js := range t.jsonStrings {
+		if err := json.Unmarshal([]byte(js), &t.defs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// the ops of the writes
+const (
+	writeInsert = "insert"
+	writeUpdate = "update"
+	writeDelete = "delete"
+)
+
+// renderer renders the templates with the values of the seeded pools
+type renderer struct {
+	dialect  Dialect
+	bindArgs bool // the placeholders become bind variables and their values the args
+	pools    map[string]map[string]*valuePool
+	tables   map[string]*tableSeed
+	rows     map[string]*rowGenerator // the fresh rows of the writes and the new placeholders per table, made on the first use
+	r        *rand.Rand
+}
+
+func newRenderer(config *config, dialect Dialect, pools map[string]map[string]*valuePool, r *rand.Rand) *renderer {
+	rd := &renderer{
+		dialect:  dialect,
+		bindArgs: config.Stress.BindArgs,
+		pools:    pools,
+		tables:   make(map[string]*tableSeed, len(config.Seed)),
+		rows:     make(map[string]*rowGenerator),
+		r:        r,
+	}
+	for i := range config.Seed {
+		s := &config.Seed[i]
+		rd.tables[s.Table] = s
+	}
+	return rd
+}
+
+// literal returns how the values go into a statement: quoted as literals,
+// or as bind variables with the values appended to args
+func (rd *renderer) literal(args *[]any) func(any) string {
+	if !rd.bindArgs {
+		return rd.dialect.Literal
+	}
+	return func(v any) string {
+		*args = append(*args, v)
+		return rd.dialect.BindVar(len(*args) - 1)
+	}
+}
+
+func (rd *renderer) render(t *template) (workload.Statement, error) {
+	var args []any
+	literal := rd.literal(&args)
+	tokens := make([]string, len(t.jsonStrings))
+	for j, def := range t.defs {
+		token, err := renderPlaceholder(def, rd.pools, rd.freshValue, rd.r, literal)
+		if err != nil {
+			return workload.Statement{}, err
+		}
+		tokens[j] = token
+	}
+	statement, err := rd.dialect.RenderSQLSelect(t.statement, t.jsonStrings, tokens)
+	if err != nil {
+		return workload.Statement{}, err
+	}
+	return workload.Statement{SQL: statement, Args: args}, nil
+}
+
+// renderWrite builds an INSERT of a fresh row, or an UPDATE or a DELETE of the rows with the sampled key values.
+// The fresh values come from the field generators of the seed: picked from the pools per the distribution,
+// the unique fields get the values no row has yet.
+func (rd *renderer) renderWrite(w *writeDef) (workload.Statement, error) {
+	s, ok := rd.tables[w.Table]
+	if !ok {
+		return workload.Statement{}, fmt.Errorf("no seed config of table %s", w.Table)
+	}
+	fields := make([]string, len(s.Fields))
+	for i, f := range s.Fields {
+		fields[i] = f.Field
+	}
+
+	var args []any
+	literal := rd.literal(&args)
+	key := w.Key
+	if len(key) == 0 {
+		key = tableKey(s)
+	}
+	if w.Op != writeInsert && len(key) == 0 {
+		return workload.Statement{}, fmt.Errorf("%s of table %s needs a key: no primary key or one unique field to default to", w.Op, w.Table)
+	}
+
+	var sql string
+	switch w.Op {
+	case writeInsert:
+		row := rd.freshRow(s)
+		vals := make([]string, len(row))
+		for i, v := range row {
+			vals[i] = literal(v)
+		}
+		sql = "INSERT INTO " + w.Table + " (" + strings.Join(fields, ",") + ") VALUES (" + strings.Join(vals, ",") + ")"
+	case writeUpdate:
+		set := w.Set
+		if len(set) == 0 {
+			for _, f := range fields {
+				if !slices.Contains(key, f) {
+					set = append(set, f)
+				}
+			}
+		}
+		if len(set) == 0 {
+			return workload.Statement{}, fmt.Errorf("update of table %s has no fields to set", w.Table)
+		}
+		row := rd.freshRow(s)
+		assignments := make([]string, len(set))
+		for i, f := range set {
+			j := slices.Index(fields, f)
+			if j < 0 {
+				return workload.Statement{}, fmt.Errorf("no field %s in table %s", f, w.Table)
+			}
+			assignments[i] = f + " = " + literal(row[j])
+		}
+		sql = "UPDATE " + w.Table + " SET " + strings.Join(assignments, ", ")
+	case writeDelete:
+		sql = "DELETE FROM " + w.Table
+	default:
+		return workload.Statement{}, fmt.Errorf("unknown write op %s: insert, update or delete", w.Op)
+	}
+
+	if w.Op != writeInsert {
+		vals, err := rd.keyValues(s, key)
+		if err != nil {
+			return workload.Statement{}, fmt.Errorf("%s of table %s: %w", w.Op, w.Table, err)
+		}
+		where := make([]string, len(key))
+		for i, f := range key {
+			where[i] = f + " = " + literal(vals[i])
+		}
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	return workload.Statement{SQL: sql, Args: args}, nil
+}
+
+// keyValues samples the key of a seeded row. The values of a key of several fields come from one row:
+// the unique fields get the pool values in the order of the rows, so the same pool index is the same row.
+// The other fields are picked at random per row, a key with one of them can't be put together from the pools.
+func (rd *renderer) keyValues(s *tableSeed, key []string) ([]any, error) {
+	pools := make([]*valuePool, len(key))
+	rows := math.MaxInt
+	for i, f := range key {
+		p, ok := rd.pools[s.Table][f]
+		if !ok || p.size() == 0 {
+			return nil, fmt.Errorf("no seeded values for %s.%s", s.Table, f)
+		}
+		pools[i] = p
+		rows = min(rows, p.size())
+	}
+	if len(key) == 1 {
+		return []any{pools[0].sample(rd.r)}, nil
+	}
+
+	for _, f := range key {
+		i := slices.IndexFunc(s.Fields, func(fs fieldSeed) bool { return fs.Field == f })
+		if i < 0 || !s.Fields[i].Unique {
+			return nil, fmt.Errorf("the key field %s is not unique, the values of a key of several fields must come from one row", f)
+		}
+	}
+	// the pools of the unique fields may hold more values than the rows seeded
+	if s.Records > 0 {
+		rows = min(rows, s.Records)
+	}
+	row := rd.r.Intn(rows)
+	vals := make([]any, len(key))
+	for i, p := range pools {
+		vals[i] = p.value(row)
+	}
+	return vals, nil
+}
+
+func (rd *renderer) freshRow(s *tableSeed) []any {
+	return rd.rowGenerator(s).fresh()
+}
+
+// freshValue is the value of a new placeholder: the value of the field in a fresh row
+func (rd *renderer) freshValue(table string, field string) (any, error) {
+	s, ok := rd.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("no seed config of table %s", table)
+	}
+	i := slices.IndexFunc(s.Fields, func(f fieldSeed) bool { return f.Field == field })
+	if i < 0 {
+		return nil, fmt.Errorf("no seed config of %s.%s", table, field)
+	}
+	return rd.rowGenerator(s).freshField(i), nil
+}
+
+func (rd *renderer) rowGenerator(s *tableSeed) *rowGenerator {
+	g, ok := rd.rows[s.Table]
+	if !ok {
+		g = newRowGenerator(s, rd.pools[s.Table], 0, rd.r)
+		rd.rows[s.Table] = g
+	}
+	return g
+}
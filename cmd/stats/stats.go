@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"text/tabwriter"
 	"time"
@@ -15,11 +17,56 @@ import (
 
 const POISON_PILL string = "POISON PILL"
 
+// the settings of the run, written on top of the stats
+var (
+	metaMu sync.Mutex
+	meta   = make(map[string]string)
+)
+
+// SetMeta records a setting of the run, like the session init statements, to tell the runs apart
+func SetMeta(key string, value string) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	meta[key] = value
+}
+
+// MarkInterrupted records in the run metadata that the run was stopped by a signal, so its stats are partial
+func MarkInterrupted() {
+	SetMeta("status", "run interrupted, the stats are partial")
+}
+
+func printMeta(w io.Writer) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+
+	if len(meta) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "**********************************************************************")
+	fmt.Fprintln(w, "                run metadata")
+	fmt.Fprintln(w, "**********************************************************************")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s: %s\n", k, meta[k])
+	}
+}
+
 type OneStatement struct {
 	ID       string
 	ThreadID string
 	Duration time.Duration
 	SQL      string
+	Err      error  // the statement failed, its duration is not in the timings
+	Outcome  string // what the statement did, like skipped for a conflicting insert, counted per outcome
+	// statements per second the ID is limited to, reported next to the observed rate
+	TargetRate float64
+	Wait       time.Duration // waiting for a connection of the pool, not in Duration
+	Timeout    bool          // Err is the statement running out of its timeout, counted apart from the other errors
+	Aborted    bool          // Err is a serialization failure or a deadlock aborting a transaction attempt, counted apart too
 }
 
 type Stats struct {
@@ -27,11 +74,32 @@ type Stats struct {
 	longest     time.Duration
 	total       time.Duration
 	Count       int
+	Errors      int
+	Timeouts    int
+	Aborts      int
 	shortestSQL string
 	longestSQL  string
 	// 100milis, 200milis,
 	Histogram        []int
 	histoDescription []string
+	Outcomes         map[string]int
+	// when the first and the last statements arrived, for the observed rate
+	first      time.Time
+	last       time.Time
+	targetRate float64
+	// waiting for the pool connections
+	waitTotal   time.Duration
+	waitLongest time.Duration
+}
+
+// rate returns the statements per second observed between the first and the last ones.
+// The aborted attempts are left out, their transaction counts once when it commits or fails.
+func (s *Stats) rate() float64 {
+	elapsed := s.last.Sub(s.first).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Count+s.Errors+s.Timeouts-1) / elapsed
 }
 
 func slot(t time.Duration) int {
@@ -43,7 +111,30 @@ func printStats(w io.Writer, id string, v *Stats) {
 	fmt.Fprintln(w, "                "+id+" stats")
 	fmt.Fprintln(w, "**********************************************************************")
 	fmt.Fprintf(w, "Count %d\n", v.Count)
+	fmt.Fprintf(w, "Errors %d\n", v.Errors)
+	if v.Timeouts > 0 {
+		fmt.Fprintf(w, "Timeouts %d\n", v.Timeouts)
+	}
+	if v.Aborts > 0 {
+		fmt.Fprintf(w, "Aborts %d\n", v.Aborts)
+	}
+	if len(v.Outcomes) > 0 {
+		outcomes := make([]string, 0, len(v.Outcomes))
+		for k, n := range v.Outcomes {
+			outcomes = append(outcomes, fmt.Sprintf("%s=%d", k, n))
+		}
+		sort.Strings(outcomes)
+		fmt.Fprintf(w, "Outcomes %s\n", strings.Join(outcomes, " "))
+	}
 	fmt.Fprintf(w, "Total duration %s\n", v.total)
+	if v.targetRate > 0 {
+		fmt.Fprintf(w, "Rate %.1f/s, target %.1f/s\n", v.rate(), v.targetRate)
+	} else {
+		fmt.Fprintf(w, "Rate %.1f/s\n", v.rate())
+	}
+	if v.waitTotal > 0 {
+		fmt.Fprintf(w, "Pool wait total %s, longest %s\n", v.waitTotal, v.waitLongest)
+	}
 	fmt.Fprintf(w, "Shortest sql %s %s\n", v.shortest, v.shortestSQL)
 	fmt.Fprintf(w, "Longest sql %s %s\n", v.longest, v.longestSQL)
 
@@ -91,6 +182,10 @@ func Collect(cc *cli.Context,
 					log.Fatalf("failed to create  stats file %s: %v", fname, err)
 				}
 				defer fs.Close()
+				ioWriter := bytes.NewBufferString("")
+				printMeta(ioWriter)
+				fs.WriteString(ioWriter.String())
+				fmt.Print(ioWriter.String())
 				for k, v := range aggregate {
 					ioWriter := bytes.NewBufferString("")
 					printStats(ioWriter, k, &v)
@@ -106,16 +201,38 @@ func Collect(cc *cli.Context,
 			s, ok := aggregate[stats.ID]
 			if !ok {
 				s = Stats{
-					999 * time.Hour,
-					0 * time.Second,
-					0 * time.Second,
-					0,
-					"",
-					"",
-					make([]int, 1000),
-					make([]string, 1000),
+					shortest:         999 * time.Hour,
+					Histogram:        make([]int, 1000),
+					histoDescription: make([]string, 1000),
+					Outcomes:         make(map[string]int),
+					first:            time.Now(),
 				}
 			}
+			s.last = time.Now()
+			s.waitTotal += stats.Wait
+			s.waitLongest = max(s.waitLongest, stats.Wait)
+			if stats.TargetRate > 0 {
+				s.targetRate = stats.TargetRate
+			}
+
+			if stats.Timeout {
+				s.Timeouts++
+				aggregate[stats.ID] = s
+				f.WriteString(fmt.Sprintf("ID=%s Thread=%s Duration=%s SQL=%s Timeout=%v\n", stats.ID, stats.ThreadID, stats.Duration, stats.SQL, stats.Err))
+				continue
+			}
+			if stats.Aborted {
+				s.Aborts++
+				aggregate[stats.ID] = s
+				f.WriteString(fmt.Sprintf("ID=%s Thread=%s Duration=%s SQL=%s Aborted=%v\n", stats.ID, stats.ThreadID, stats.Duration, stats.SQL, stats.Err))
+				continue
+			}
+			if stats.Err != nil {
+				s.Errors++
+				aggregate[stats.ID] = s
+				f.WriteString(fmt.Sprintf("ID=%s Thread=%s Duration=%s SQL=%s Error=%v\n", stats.ID, stats.ThreadID, stats.Duration, stats.SQL, stats.Err))
+				continue
+			}
 
 			if s.longest < stats.Duration {
 				s.longest = stats.Duration
@@ -127,6 +244,9 @@ func Collect(cc *cli.Context,
 				s.shortestSQL = stats.SQL
 			}
 			s.Count += 1
+			if len(stats.Outcome) > 0 {
+				s.Outcomes[stats.Outcome]++
+			}
 			s.total += stats.Duration
 			s.Histogram[slot(stats.Duration)]++
 			aggregate[stats.ID] = s
@@ -0,0 +1,357 @@
+package stress
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// capacityStep is what a step of the capacity search measured
+type capacityStep struct {
+	Threads   int
+	Count     int
+	Errors    int
+	Elapsed   time.Duration
+	Latency   time.Duration // the percentile of the SQL durations, the failed ones included
+	durations []time.Duration
+}
+
+func (s *capacityStep) throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Count) / s.Elapsed.Seconds()
+}
+
+func (s *capacityStep) errorRate() float64 {
+	if s.Count+s.Errors == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count+s.Errors)
+}
+
+// percentile returns the duration that the p (0..100) percent of the durations do not exceed
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	d := slices.Clone(durations)
+	slices.Sort(d)
+	i := int(math.Ceil(p/100*float64(len(d)))) - 1
+	return d[min(max(i, 0), len(d)-1)]
+}
+
+// capacitySearch runs the SQLs of an ID on more and more threads, a step of stepDuration per thread count,
+// to find the most throughput with the latency percentile under the SLO and the errors under the limit
+type capacitySearch struct {
+	id           string
+	slo          time.Duration
+	percentile   float64
+	maxErrorRate float64
+	stepDuration time.Duration
+	maxThreads   int
+}
+
+func newCapacitySearch(cc *cli.Context, id string) (*capacitySearch, error) {
+	c := &capacitySearch{
+		id:           id,
+		slo:          cc.Duration("capacity-slo"),
+		percentile:   cc.Float64("capacity-percentile"),
+		maxErrorRate: cc.Float64("capacity-max-errors"),
+		stepDuration: cc.Duration("capacity-step"),
+		maxThreads:   cc.Int("capacity-max-threads"),
+	}
+	if c.slo <= 0 {
+		return nil, fmt.Errorf("--find-capacity needs the --capacity-slo latency, like 100ms")
+	}
+	if c.percentile <= 0 || c.percentile > 100 {
+		return nil, fmt.Errorf("--capacity-percentile must be above 0 and at most 100")
+	}
+	if c.stepDuration <= 0 || c.maxThreads < 1 {
+		return nil, fmt.Errorf("--capacity-step and --capacity-max-threads must be positive")
+	}
+	return c, nil
+}
+
+// measure adds a SQL the step ran. The failed SQLs are in the latency too, with the time they took,
+// and a timed out one over the SLO: it would have run longer, and its timeout may be shorter than the SLO.
+func (c *capacitySearch) measure(step *capacityStep, s stats.OneStatement) {
+	d := s.Duration
+	switch {
+	case s.Timeout:
+		step.Errors++
+		d = max(d, c.slo+time.Nanosecond)
+	case s.Err != nil:
+		step.Errors++
+	default:
+		step.Count++
+	}
+	step.durations = append(step.durations, d)
+}
+
+// passed tells if the step kept the latency and the errors under the limits
+func (c *capacitySearch) passed(s *capacityStep) bool {
+	return s.Count > 0 && s.Latency <= c.slo && s.errorRate() <= c.maxErrorRate
+}
+
+// search doubles the threads from 1 till a step fails or the max threads, then bisects between the last step
+// that passed and the first one that failed. run runs a step on the given threads.
+// It returns the steps in the order they ran and the one of the most throughput that passed, nil if none did.
+func (c *capacitySearch) search(run func(threads int) (*capacityStep, error)) ([]*capacityStep, *capacityStep, error) {
+	var steps []*capacityStep
+	var best *capacityStep
+	try := func(threads int) (bool, error) {
+		s, err := run(threads)
+		if err != nil {
+			return false, err
+		}
+		steps = append(steps, s)
+		ok := c.passed(s)
+		if ok && (best == nil || s.throughput() > best.throughput()) {
+			best = s
+		}
+		return ok, nil
+	}
+
+	lo, hi := 0, 0 // the most threads that passed, the fewest that failed
+	for threads := 1; ; threads = min(threads*2, c.maxThreads) {
+		ok, err := try(threads)
+		if err != nil {
+			return steps, best, err
+		}
+		if !ok {
+			hi = threads
+			break
+		}
+		lo = threads
+		if threads == c.maxThreads {
+			return steps, best, nil
+		}
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := try(mid)
+		if err != nil {
+			return steps, best, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return steps, best, nil
+}
+
+// report writes the table of the steps and the capacity found
+func (c *capacitySearch) report(w io.Writer, steps []*capacityStep, best *capacityStep) {
+	tw := tabwriter.NewWriter(w, 1, 1, 2, ' ', 0)
+	fmt.Fprintf(tw, "step\tthreads\tsqls\terrors\terror rate\tthroughput/s\tp%g\tresult\n", c.percentile)
+	for i, s := range steps {
+		result := "ok"
+		switch {
+		case s.Count == 0:
+			result = "no sqls"
+		case s.Latency > c.slo:
+			result = "over slo"
+		case s.errorRate() > c.maxErrorRate:
+			result = "errors"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.4f\t%.1f\t%s\t%s\n",
+			i+1, s.Threads, s.Count, s.Errors, s.errorRate(), s.throughput(), s.Latency, result)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "Capacity of %s: %s\n", c.id, c.summary(best))
+}
+
+func (c *capacitySearch) summary(best *capacityStep) string {
+	if best == nil {
+		return fmt.Sprintf("none, p%g over %s or error rate over %g on 1 thread", c.percentile, c.slo, c.maxErrorRate)
+	}
+	return fmt.Sprintf("%.1f/s on %d threads, p%g %s", best.throughput(), best.Threads, c.percentile, best.Latency)
+}
+
+// findCapacity runs the capacity search of the ID of --find-capacity on its SQLs of the sqls file,
+// fed over and over for each step
+func findCapacity(cc *cli.Context,
+	rd workload.Reader,
+	new func(dbtype string, dburl string) run,
+) error {
+	id := strings.Join(strings.Fields(cc.String("find-capacity")), "+")
+	c, err := newCapacitySearch(cc, id)
+	if err != nil {
+		return err
+	}
+	g, statements, err := readGroup(rd, id)
+	if err != nil {
+		return err
+	}
+	timeout := cc.Duration("statement-timeout")
+	if len(g.Timeout) > 0 {
+		if timeout, err = time.ParseDuration(g.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout for id %s: %w", id, err)
+		}
+	}
+	retries := cc.Int("tx-retries")
+	if g.Retries != nil {
+		retries = *g.Retries
+	}
+	tasks := make([]db.Task, len(statements))
+	for i, st := range statements {
+		if tasks[i], err = newTask(id, st, timeout, retries); err != nil {
+			return err
+		}
+	}
+
+	statsChan := make(chan stats.OneStatement, 1)
+	var wgStats sync.WaitGroup
+	wgStats.Add(1)
+	go stats.Collect(cc, statsChan, &wgStats)
+
+	r := new(cc.String("db-type"), cc.String("db-url"))
+	init := append(slices.Clone(cc.StringSlice("session-init")), g.SessionInit...)
+	if len(init) > 0 {
+		stats.SetMeta("sessionInit "+id, strings.Join(init, "; "))
+	}
+	if err := r.SetSessionInit(cc, init); err != nil {
+		return err
+	}
+
+	// the stats of the threads are measured for the step and passed on to the collector.
+	// A poison pill is not passed on, it tells the stats of the step before it are all measured.
+	measured := make(chan stats.OneStatement, 1)
+	flushed := make(chan struct{})
+	var step *capacityStep
+	var stepID string
+	go func() {
+		for s := range measured {
+			if s.ID == stats.POISON_PILL {
+				flushed <- struct{}{}
+				continue
+			}
+			// the transaction steps and the aborted attempts are in the whole transaction
+			if s.ID == stepID && !s.Aborted {
+				c.measure(step, s)
+			}
+			statsChan <- s
+		}
+	}()
+
+	sqls := make(chan db.Task, 1)
+	var wg sync.WaitGroup
+	spawn := func(threadID string) {
+		wg.Add(1)
+		go r.RunSQLs(cc, threadID, measured, &wg, sqls)
+	}
+
+	n := 0
+	steps, best, err := c.search(func(threads int) (*capacityStep, error) {
+		n++
+		step = &capacityStep{Threads: threads}
+		stepID = fmt.Sprintf("%s-capacity%d-%dthreads", id, n, threads)
+		slog.Info("capacity step", "ID", id, "step", n, "threads", threads, "duration", c.stepDuration)
+
+		ld, err := newLoad(stepID, &workload.Group{Threads: threads}, spawn, sqls)
+		if err != nil {
+			return nil, err
+		}
+		ld.start()
+		start := time.Now()
+		end := time.After(c.stepDuration)
+		// the SQLs over and over, each weight times
+	feed:
+		for i, left := -1, 0; ; left-- {
+			if left == 0 {
+				i = (i + 1) % len(tasks)
+				left = max(statements[i].Weight, 1)
+			}
+			task := tasks[i]
+			task.SQLID = stepID
+			select {
+			case sqls <- task:
+			case <-end:
+				break feed
+			case <-cc.Context.Done():
+				break feed
+			}
+		}
+		ld.stop()
+		wg.Wait()
+		measured <- stats.OneStatement{ID: stats.POISON_PILL}
+		<-flushed
+
+		step.Elapsed = time.Since(start)
+		step.Latency = percentile(step.durations, c.percentile)
+		step.durations = nil
+		if cc.Context.Err() != nil {
+			return step, fmt.Errorf("capacity search interrupted")
+		}
+		return step, nil
+	})
+
+	close(measured)
+
+	stats.SetMeta("capacity "+id, c.summary(best))
+	if cc.Context.Err() != nil {
+		stats.MarkInterrupted()
+	}
+	statsChan <- stats.OneStatement{
+		ID: stats.POISON_PILL,
+	}
+	wgStats.Wait()
+
+	var b strings.Builder
+	c.report(&b, steps, best)
+	fmt.Print(b.String())
+	fname := filepath.Join(cc.String("out-dir"), cc.Command.Name+"-capacity.txt")
+	if werr := os.WriteFile(fname, []byte(b.String()), 0644); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
+
+// readGroup reads the group of the ID and its statements, skipping the other groups
+func readGroup(rd workload.Reader, id string) (*workload.Group, []workload.Statement, error) {
+	var g *workload.Group
+	var statements []workload.Statement
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the sqls: %w", err)
+		}
+		if rec.Group != nil {
+			if g != nil {
+				break
+			}
+			if strings.Join(strings.Fields(rec.Group.ID), "+") == id {
+				g = rec.Group
+			}
+			continue
+		}
+		if g != nil {
+			statements = append(statements, *rec.Statement)
+		}
+	}
+	if g == nil {
+		return nil, nil, fmt.Errorf("no id %s in the sqls", id)
+	}
+	if len(statements) == 0 {
+		return nil, nil, fmt.Errorf("no sql statements for id %s", id)
+	}
+	return g, statements, nil
+}
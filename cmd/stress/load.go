@@ -0,0 +1,103 @@
+package stress
+
+import (
+	"fmt"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"log/slog"
+	"time"
+)
+
+// load runs the threads of a group: its Threads all along, or the ones of each stage of its profile in turn
+type load struct {
+	id     string
+	stages []workload.Stage // one stage holding forever without a profile
+	stage  int
+	timer  *time.Timer // the end of the stage, nil without a profile
+
+	spawn   func(threadID string)
+	sqls    chan db.Task
+	started bool
+	running int  // the threads started and not stopped
+	spawned int  // all the threads started, to number them
+	done    bool // the last stage is over
+}
+
+func newLoad(id string, g *workload.Group, spawn func(threadID string), sqls chan db.Task) (*load, error) {
+	l := &load{id: id, spawn: spawn, sqls: sqls}
+	if g.Profile == nil {
+		l.stages = []workload.Stage{{Threads: g.Threads}}
+		return l, nil
+	}
+	stages, err := g.Profile.Stages()
+	if err != nil {
+		return nil, fmt.Errorf("id %s: %w", id, err)
+	}
+	l.stages = stages
+	return l, nil
+}
+
+// start spawns the threads of the first stage
+func (l *load) start() {
+	l.started = true
+	l.resize(l.stages[0].Threads)
+	if len(l.stages) > 1 || l.stages[0].Hold > 0 {
+		l.timer = time.NewTimer(l.stages[0].Hold)
+		l.log()
+	}
+}
+
+// taskID is the ID the SQLs are reported under: the stage of the profile gets an ID of its own
+func (l *load) taskID() string {
+	if l.timer == nil {
+		return l.id
+	}
+	return fmt.Sprintf("%s-load%d-%dthreads", l.id, l.stage+1, l.stages[l.stage].Threads)
+}
+
+// expired fires when the stage is over, never without a profile
+func (l *load) expired() <-chan time.Time {
+	if l.timer == nil {
+		return nil
+	}
+	return l.timer.C
+}
+
+// next goes on to the next stage, or marks the profile done after the last one
+func (l *load) next() {
+	if l.stage == len(l.stages)-1 {
+		l.done = true
+		slog.Info("load profile is over, the SQLs left are skipped", "ID", l.id)
+		return
+	}
+	l.stage++
+	l.resize(l.stages[l.stage].Threads)
+	l.timer.Reset(l.stages[l.stage].Hold)
+	l.log()
+}
+
+// resize starts or stops the threads to have n running, the stopped ones finish their SQLs first
+func (l *load) resize(n int) {
+	for ; l.running < n; l.running++ {
+		l.spawn(fmt.Sprintf("thread-%d", l.spawned))
+		l.spawned++
+	}
+	for ; l.running > n; l.running-- {
+		l.sqls <- db.POISON_TASK
+	}
+}
+
+// stop sends a poison pill to each thread running
+func (l *load) stop() int {
+	n := l.running
+	l.resize(0)
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	return n
+}
+
+func (l *load) log() {
+	slog.Info("load stage", "ID", l.id, "stage", l.stage+1, "of", len(l.stages), "threads", l.stages[l.stage].Threads,
+		"hold", l.stages[l.stage].Hold)
+}
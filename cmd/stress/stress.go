@@ -1,23 +1,25 @@
 package stress
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/seed"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
+	"io"
 	"log"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
-const THREADS string = "THREADS = "
-const ID string = "ID = "
-
 type run interface {
 	RunSQLs(cc *cli.Context, threadID string, statsChan chan stats.OneStatement, wg *sync.WaitGroup, sql chan db.Task)
+	SetSessionInit(cc *cli.Context, sessionInit []string) error
 }
 
 // to allow DB mocking
@@ -42,38 +44,73 @@ func Stress(cc *cli.Context) error {
 	}
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, opts)))
 
-	return doStress(cc,
+	d := db.New(cc.String("db-type"), cc.String("db-url"))
+	rd, threads, err := openWorkload(cc, d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rd.Close()
+
+	if len(cc.String("find-capacity")) > 0 {
+		threads = cc.Int("capacity-max-threads")
+	}
+	// one pool for the run, the threads of an ID are done before the next ID starts
+	d.SetPoolOptions(db.PoolOptionsFromFlags(cc, threads))
+	defer d.Close(cc)
+
+	if len(cc.String("find-capacity")) > 0 {
+		return findCapacity(cc, rd,
+			func(dbType string, dbUrl string) run {
+				return d
+			},
+		)
+	}
+	return doStress(cc, rd,
 		func(dbType string, dbUrl string) run {
-			return db.New(dbType, dbUrl)
+			return d
 		},
 	)
 }
 
-func doStress(cc *cli.Context,
-	new func(dbtype string, dburl string) run,
-) error {
+// openWorkload returns the reader of the SQLs and the most threads a group of them runs on, to size the pool.
+// The SQLs are read from the input file, or rendered on the fly of the --config templates with the --pools-file values.
+// An input file without the header the seed writes is read through for the threads, unless --max-conns sizes the pool.
+func openWorkload(cc *cli.Context, dialect seed.Dialect) (workload.Reader, int, error) {
+	if config := cc.Path("config"); len(config) > 0 {
+		if len(cc.Path("pools-file")) == 0 {
+			return nil, 0, fmt.Errorf("--config needs the --pools-file the seed saved")
+		}
+		g, err := seed.NewGenerator(config, cc.Path("pools-file"), dialect)
+		if err != nil {
+			return nil, 0, err
+		}
+		return g, g.MaxThreads(), nil
+	}
+
 	path := cc.Path("input-file")
 	if len(path) == 0 {
-		return fmt.Errorf("no input file path given")
+		return nil, 0, fmt.Errorf("no input file path given")
 	}
-
-	file, err := os.Open(path)
+	// the format goes by the extension: JSON Lines for .jsonl, the ID/THREADS text otherwise
+	rd, err := workload.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
-	defer file.Close()
+	if cc.Int("max-conns") > 0 {
+		return rd, 0, nil
+	}
+	return rd, workload.MaxThreads(path), nil
+}
 
-	statsChan := make(chan stats.OneStatement, 1)
+func doStress(cc *cli.Context,
+	rd workload.Reader,
+	new func(dbtype string, dburl string) run,
+) error {
 
-	scanner := bufio.NewScanner(file)
-	const maxCapacity int = 4194304
-	buf := make([]byte, maxCapacity)
-	scanner.Buffer(buf, maxCapacity)
+	statsChan := make(chan stats.OneStatement, 1)
 
 	sqls := make(chan db.Task, 1)
 
-	threadsCnt := 0
-	oldThreadsCnt := 0
 	var wg sync.WaitGroup
 	var wgStats sync.WaitGroup
 	count := 0
@@ -83,79 +120,125 @@ func doStress(cc *cli.Context,
 	wgStats.Add(1)
 	go stats.Collect(cc, statsChan, &wgStats)
 
+	r := new(cc.String("db-type"), cc.String("db-url"))
+	spawn := func(threadID string) {
+		wg.Add(1)
+		go r.RunSQLs(cc, threadID, statsChan, &wg, sqls)
+	}
 	sqlGroups := make(map[string]int)
-	for scanner.Scan() {
-		// get a line
-		s := scanner.Text()
+	var sessionInit []string
+	var timeout time.Duration
+	retries := 0
+	// the threads of an ID, spawned on its first SQL
+	var ld *load
+	for {
+		// interrupted: no more SQLs are fed, the threads finish the ones in flight
+		if cc.Context.Err() != nil {
+			break
+		}
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the sqls: %w", err)
+		}
 
-		if strings.HasPrefix(s, ID) {
-			_, err := fmt.Sscanf(s, ID+"%s", &id)
-			if err != nil {
-				return err
-			}
+		if g := rec.Group; g != nil {
+			id = strings.Join(strings.Fields(g.ID), "+")
 			sqlGroups[id] = 0
-
-			scanner.Scan()
-			s = scanner.Text()
-			_, err = fmt.Sscanf(s, THREADS+"%d", &threadsCnt)
-			if err != nil {
-				return err
-			}
-			if threadsCnt < 1 {
-				log.Fatal(fmt.Sprintf("Invalid threads count for id %s %d", id, threadsCnt))
+			if g.Profile == nil && g.Threads < 1 {
+				log.Fatal(fmt.Sprintf("Invalid threads count for id %s %d", id, g.Threads))
 			}
-			// batch == 0 means beginning of the file, nothing is running yet
-			if count > 0 {
-				for i := 0; i < oldThreadsCnt; i++ {
-					sqls <- db.POISON_TASK
-				}
-				slog.Info("Wrote poison pills to the channel", "count", oldThreadsCnt)
-				// wait till all threadsCnt swallow poison pills, one pill per thread
+			// nothing is running yet at the beginning of the file
+			if ld != nil && ld.started {
+				slog.Info("Wrote poison pills to the channel", "count", ld.stop())
+				// wait till all the threads swallow poison pills, one pill per thread
 				wg.Wait()
 				count = 0
 			}
-
-			if threadsCnt > 0 {
-				oldThreadsCnt = threadsCnt
-				for i := 0; i < threadsCnt; i++ {
-					r := new(cc.String("db-type"), cc.String("db-url"))
-					wg.Add(1)
-					go r.RunSQLs(cc,
-						fmt.Sprintf("thread-%d", i),
-						statsChan,
-						&wg,
-						sqls)
+			if ld, err = newLoad(id, g, spawn, sqls); err != nil {
+				return err
+			}
+			sessionInit = g.SessionInit
+			timeout = cc.Duration("statement-timeout")
+			if len(g.Timeout) > 0 {
+				if timeout, err = time.ParseDuration(g.Timeout); err != nil {
+					return fmt.Errorf("invalid timeout for id %s: %w", id, err)
 				}
 			}
+			retries = cc.Int("tx-retries")
+			if g.Retries != nil {
+				retries = *g.Retries
+			}
 			continue
 		}
 
-		// we get here on a non "threadsCnt = " line
-		// feed sql to the channel
-		sqls <- db.Task{
-			id,
-			s,
+		if len(id) == 0 {
+			return fmt.Errorf("sql before any ID")
+		}
+		// the load profile is over, the SQLs left of the ID are skipped
+		if ld.done {
+			continue
 		}
-		count++
-		sqlGroups[id] = count
-		if count%100 == 0 {
-			slog.Info("sqls fed", "ID", id, "count", count)
+		st := rec.Statement
+		if !ld.started {
+			// the --session-init statements go first
+			init := append(slices.Clone(cc.StringSlice("session-init")), sessionInit...)
+			if len(init) > 0 {
+				stats.SetMeta("sessionInit "+id, strings.Join(init, "; "))
+			}
+			if err := r.SetSessionInit(cc, init); err != nil {
+				return err
+			}
+			if timeout > 0 {
+				stats.SetMeta("timeout "+id, timeout.String())
+			}
+			ld.start()
+		}
+
+		task, err := newTask(ld.taskID(), *st, timeout, retries)
+		if err != nil {
+			return err
+		}
+		// feed the SQL to the channel, weight times
+		for n := max(st.Weight, 1); n > 0 && cc.Context.Err() == nil && !ld.done; {
+			select {
+			case sqls <- task:
+				n--
+				count++
+				sqlGroups[id] = count
+				if count%100 == 0 {
+					slog.Info("sqls fed", "ID", id, "count", count)
+				}
+			case <-ld.expired():
+				ld.next()
+				task.SQLID = ld.taskID()
+			case <-cc.Context.Done():
+			}
 		}
 	}
 
 	// input file has been completely read
-	for i := 0; i < oldThreadsCnt; i++ {
-		sqls <- db.POISON_TASK
+	if ld != nil && ld.started {
+		slog.Info("Input file processed. Wrote final poison pills to the channel", "count", ld.stop())
 	}
-	slog.Info("Input file processed. Wrote final poison pills to the channel", "count", oldThreadsCnt)
 
 	wg.Wait()
 
+	interrupted := cc.Context.Err() != nil
+	if interrupted {
+		stats.MarkInterrupted()
+	}
 	statsChan <- stats.OneStatement{
 		ID: stats.POISON_PILL,
 	}
 	wgStats.Wait()
 
+	if interrupted {
+		return fmt.Errorf("stress interrupted, the stats are partial")
+	}
+
 	for k, v := range sqlGroups {
 		if v == 0 {
 			return fmt.Errorf("no sql statements for id  %s", k)
@@ -164,3 +247,25 @@ func doStress(cc *cli.Context,
 
 	return nil
 }
+
+// newTask makes the task of a statement of the ID, with the timeout and retries of its group
+func newTask(id string, st workload.Statement, timeout time.Duration, retries int) (db.Task, error) {
+	task := db.Task{
+		SQLID:      id,
+		SQL:        st.SQL,
+		Args:       st.Args,
+		Timeout:    timeout,
+		ExpectRows: st.ExpectRows,
+		Retries:    retries,
+	}
+	for _, step := range st.Transaction {
+		task.Steps = append(task.Steps, db.Step{SQL: step.SQL, Args: step.Args, ExpectRows: step.ExpectRows})
+	}
+	if len(st.Timeout) > 0 {
+		var err error
+		if task.Timeout, err = time.ParseDuration(st.Timeout); err != nil {
+			return task, fmt.Errorf("invalid timeout for a sql of id %s: %w", id, err)
+		}
+	}
+	return task, nil
+}
@@ -1,15 +1,20 @@
 package stress
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"github.com/urfave/cli/v2"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/db"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd/stats"
+	"github.com/yurizf/rdb-seeder-stress-tester/cmd/workload"
 	"log"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -58,6 +63,10 @@ func (s *mockSelect) RunSQLs(cc *cli.Context,
 
 }
 
+func (s *mockSelect) SetSessionInit(cc *cli.Context, sessionInit []string) error {
+	return nil
+}
+
 func outDir() string {
 	_, fname, _, _ := runtime.Caller(0)
 	top := filepath.Dir(filepath.Dir(filepath.Dir(fname)))
@@ -92,6 +101,15 @@ func mockCLIConetext() *cli.Context {
 	return cc
 }
 
+func openSQLs(t *testing.T, cc *cli.Context) workload.Reader {
+	rd, _, err := openWorkload(cc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rd.Close() })
+	return rd
+}
+
 func Test_doStress(t *testing.T) {
 	type args struct {
 		cc *cli.Context
@@ -113,7 +131,7 @@ func Test_doStress(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := doStress(tt.args.cc,
+			if err := doStress(tt.args.cc, openSQLs(t, tt.args.cc),
 				func(dbType string, dbUrl string) run {
 					return tt.args.db
 				}); (err != nil) != tt.wantErr {
@@ -123,3 +141,208 @@ func Test_doStress(t *testing.T) {
 		})
 	}
 }
+
+func Test_doStressInterrupted(t *testing.T) {
+	cc := mockCLIConetext()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cc.Context = ctx
+
+	err := doStress(cc, openSQLs(t, cc),
+		func(dbType string, dbUrl string) run {
+			return &mockSelect{}
+		})
+	if err == nil {
+		t.Fatal("doStress() of an interrupted run returned no error")
+	}
+
+	b, err := os.ReadFile(filepath.Join(outDir(), "teststats.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "run interrupted") {
+		t.Errorf("no run interrupted marker in the stats:\n%s", b)
+	}
+}
+
+func Test_doStressJSONL(t *testing.T) {
+	cc := mockCLIConetext()
+	path := filepath.Join(outDir(), "sqls.jsonl")
+	jsonl := `{"group":{"id":"jsonl-group","threads":2,"timeout":"2s"}}
+{"sql":"SELECT count(*)\nFROM t","weight":5}
+{"sql":"SELECT * FROM t WHERE a = $1","args":[7]}
+`
+	if err := os.WriteFile(path, []byte(jsonl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc.Set("input-file", path)
+
+	if err := doStress(cc, openSQLs(t, cc),
+		func(dbType string, dbUrl string) run {
+			return &mockSelect{}
+		}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(outDir(), "teststats.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "jsonl-group stats") || !strings.Contains(string(b), "Count 6\n") {
+		t.Errorf("no 6 SQLs of jsonl-group in the stats:\n%.500s", b)
+	}
+}
+
+// busySelect takes a millisecond per SQL and counts the threads running at once
+type busySelect struct {
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (s *busySelect) RunSQLs(cc *cli.Context, threadID string, statsChan chan stats.OneStatement, wg *sync.WaitGroup, sql chan db.Task) {
+	defer wg.Done()
+	s.mu.Lock()
+	s.running++
+	s.most = max(s.most, s.running)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}()
+
+	for task := range sql {
+		if task.SQL == stats.POISON_PILL {
+			return
+		}
+		time.Sleep(time.Millisecond)
+		statsChan <- stats.OneStatement{ID: task.SQLID, ThreadID: threadID, SQL: task.SQL, Duration: time.Millisecond}
+	}
+}
+
+func (s *busySelect) SetSessionInit(cc *cli.Context, sessionInit []string) error {
+	return nil
+}
+
+func Test_doStressProfile(t *testing.T) {
+	cc := mockCLIConetext()
+	path := filepath.Join(outDir(), "profile.jsonl")
+	// far more SQLs than the profile has time for, the ones left are skipped
+	jsonl := `{"group":{"id":"stepped","threads":1,"profile":{"kind":"step","from":1,"to":5,"step":2,"duration":"100ms"}}}
+{"sql":"SELECT 1","weight":1000000}
+{"group":{"id":"after","threads":2}}
+{"sql":"SELECT 2","weight":10}
+`
+	if err := os.WriteFile(path, []byte(jsonl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc.Set("input-file", path)
+
+	s := &busySelect{}
+	start := time.Now()
+	if err := doStress(cc, openSQLs(t, cc), func(dbType string, dbUrl string) run { return s }); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the profile of 300ms took %s", elapsed)
+	}
+	if s.most != 5 {
+		t.Errorf("ran %d threads at most, want 5", s.most)
+	}
+
+	b, err := os.ReadFile(filepath.Join(outDir(), "teststats.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"stepped-load1-1threads", "stepped-load2-3threads", "stepped-load3-5threads", "after"} {
+		if !strings.Contains(string(b), " "+id+" stats") {
+			t.Errorf("no stats of %s:\n%.1000s", id, b)
+		}
+	}
+}
+
+func Test_capacitySearch(t *testing.T) {
+	c := &capacitySearch{id: "q", slo: 100 * time.Millisecond, percentile: 99, maxErrorRate: 0.01, maxThreads: 64}
+	// the throughput goes up with the threads, the latency knees past 12 threads
+	var tried []int
+	steps, best, err := c.search(func(threads int) (*capacityStep, error) {
+		tried = append(tried, threads)
+		s := &capacityStep{Threads: threads, Count: 100 * threads, Elapsed: time.Second, Latency: 50 * time.Millisecond}
+		if threads > 12 {
+			s.Latency = 200 * time.Millisecond
+		}
+		return s, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 4, 8, 16, 12, 14, 13}; !reflect.DeepEqual(tried, want) {
+		t.Errorf("tried %v threads, want %v", tried, want)
+	}
+	if len(steps) != len(tried) || best == nil || best.Threads != 12 {
+		t.Errorf("best %+v of %d steps, want 12 threads", best, len(steps))
+	}
+
+	// the errors fail the step as well
+	_, best, _ = c.search(func(threads int) (*capacityStep, error) {
+		return &capacityStep{Threads: threads, Count: 100, Errors: threads, Elapsed: time.Second}, nil
+	})
+	if best == nil || best.Threads != 1 {
+		t.Errorf("best %+v, want 1 thread with 1%% errors", best)
+	}
+
+	if p := percentile([]time.Duration{5, 1, 4, 2, 3, 6, 7, 8, 9, 10}, 90); p != 9 {
+		t.Errorf("percentile() = %d, want 9", p)
+	}
+
+	// a timed out SQL is over the SLO even with a shorter timeout, a failed one is in the latency with its duration
+	c = &capacitySearch{id: "q", slo: 100 * time.Millisecond, percentile: 95, maxErrorRate: 0.2, maxThreads: 64}
+	step := &capacityStep{Elapsed: time.Second}
+	for i := 0; i < 8; i++ {
+		c.measure(step, stats.OneStatement{Duration: 10 * time.Millisecond})
+	}
+	c.measure(step, stats.OneStatement{Duration: 80 * time.Millisecond, Err: errors.New("failed")})
+	c.measure(step, stats.OneStatement{Duration: 50 * time.Millisecond, Err: context.DeadlineExceeded, Timeout: true})
+	step.Latency = percentile(step.durations, c.percentile)
+	if step.Count != 8 || step.Errors != 2 || step.Latency <= c.slo {
+		t.Errorf("measured %d SQLs, %d errors, p95 %s, want 8, 2 and over the %s SLO", step.Count, step.Errors, step.Latency, c.slo)
+	}
+	if c.passed(step) {
+		t.Error("a step with a timed out SQL at p95 passed")
+	}
+}
+
+func Test_findCapacity(t *testing.T) {
+	path := filepath.Join(outDir(), "capacity.jsonl")
+	jsonl := `{"group":{"id":"other","threads":1}}
+{"sql":"SELECT 1"}
+{"group":{"id":"target","threads":1}}
+{"sql":"SELECT 2","weight":3}
+{"sql":"SELECT 3"}
+`
+	if err := os.WriteFile(path, []byte(jsonl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("", flag.ExitOnError)
+	for name, value := range map[string]string{
+		"input-file": path, "out-dir": outDir(),
+		"find-capacity": "target", "capacity-slo": "10ms", "capacity-percentile": "99",
+		"capacity-step": "50ms", "capacity-max-threads": "4",
+	} {
+		fs.String(name, value, "")
+	}
+	cc := cli.NewContext(cli.NewApp(), fs, nil)
+	cc.Command.Name = "test"
+
+	if err := findCapacity(cc, openSQLs(t, cc), func(dbType string, dbUrl string) run { return &busySelect{} }); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(outDir(), "test-capacity.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "on 4 threads, p99 1ms") {
+		t.Errorf("no capacity of 4 threads in\n%s", b)
+	}
+}
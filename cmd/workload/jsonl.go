@@ -0,0 +1,112 @@
+package workload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The JSON Lines format: an optional max threads record first, then a group header record, then a record per SQL of the group
+//
+//	{"maxThreads":5}
+//	{"group":{"id":"sql-query-1","threads":5,"sessionInit":["SET work_mem = '64MB'"],"timeout":"2s"}}
+//	{"sql":"SELECT * FROM t WHERE a = $1 AND b = $2","args":[7,"abc"]}
+//	{"sql":"SELECT count(*)\nFROM t","weight":10,"expectRows":1}
+//	{"transaction":[{"sql":"SELECT b FROM t WHERE a = $1 FOR UPDATE","args":[7]},{"sql":"UPDATE t SET b = $1 WHERE a = $2","args":["x",7]}]}
+type jsonlRecord struct {
+	MaxThreads int    `json:"maxThreads,omitempty"`
+	Group      *Group `json:"group,omitempty"`
+	*Statement
+}
+
+type jsonlReader struct {
+	f       *os.File
+	scanner *bufio.Scanner
+	lineNo  int
+}
+
+func newJSONLReader(f *os.File) *jsonlReader {
+	scanner := bufio.NewScanner(f)
+	const maxCapacity int = 4194304
+	scanner.Buffer(make([]byte, maxCapacity), maxCapacity)
+	return &jsonlReader{f: f, scanner: scanner}
+}
+
+func (r *jsonlReader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.lineNo++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		d := json.NewDecoder(bytes.NewReader(line))
+		d.UseNumber()
+		var rec jsonlRecord
+		if err := d.Decode(&rec); err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.lineNo, err)
+		}
+		if rec.Group != nil {
+			return Record{Group: rec.Group}, nil
+		}
+		if rec.MaxThreads > 0 && rec.Statement == nil {
+			continue
+		}
+		if rec.Statement == nil || len(rec.SQL) == 0 && len(rec.Transaction) == 0 {
+			return Record{}, fmt.Errorf("line %d: neither a group nor a sql", r.lineNo)
+		}
+		if err := numbers(rec.Args); err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.lineNo, err)
+		}
+		for i, step := range rec.Transaction {
+			if len(step.SQL) == 0 {
+				return Record{}, fmt.Errorf("line %d: no sql of transaction step %d", r.lineNo, i+1)
+			}
+			if err := numbers(step.Args); err != nil {
+				return Record{}, fmt.Errorf("line %d step %d: %w", r.lineNo, i+1, err)
+			}
+		}
+		return Record{Statement: rec.Statement}, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+func (r *jsonlReader) Close() error {
+	return r.f.Close()
+}
+
+type jsonlWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// Header writes no record for no threads, {} would be neither a header nor a SQL
+func (w *jsonlWriter) Header(maxThreads int) error {
+	if maxThreads <= 0 {
+		return nil
+	}
+	return w.enc.Encode(jsonlRecord{MaxThreads: maxThreads})
+}
+
+func (w *jsonlWriter) Group(g Group) error {
+	return w.enc.Encode(jsonlRecord{Group: &g})
+}
+
+func (w *jsonlWriter) Statement(s Statement) error {
+	return w.enc.Encode(jsonlRecord{Statement: &s})
+}
+
+func (w *jsonlWriter) Close() error {
+	return w.f.Close()
+}
+
+// marshalArgs renders the args as a JSON array, [] rather than null for none
+func marshalArgs(args []any) ([]byte, error) {
+	return json.Marshal(append([]any{}, args...))
+}
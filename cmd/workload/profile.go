@@ -0,0 +1,97 @@
+package workload
+
+import (
+	"fmt"
+	"time"
+)
+
+// the load profile kinds
+const (
+	ProfileRamp  = "ramp"  // From to To threads evenly over Duration, then To for Hold
+	ProfileStep  = "step"  // From, From+Step, ... To threads, each for Duration
+	ProfileSpike = "spike" // From threads for Duration, To for Hold, From for Duration again
+)
+
+// Profile varies the threads of a group over time instead of running Threads all along.
+// The group runs till the profile ends, skipping the SQLs left, or till its SQLs run out.
+type Profile struct {
+	Kind string `json:"kind"`
+	From int    `json:"from"` // the threads to start with
+	To   int    `json:"to"`   // the threads to end with, the ones of the spike for spike
+	// ramp: the threads added at a time, 1 by default; step: the threads added each step
+	Step int `json:"step,omitempty"`
+	// ramp: how long it takes to get from From to To; step: how long each step holds;
+	// spike: how long From holds before and after the spike
+	Duration string `json:"duration"`
+	// ramp: how long To holds after the ramp; spike: how long the spike lasts
+	Hold string `json:"hold,omitempty"`
+}
+
+// Stage is a thread count of a profile and how long it holds
+type Stage struct {
+	Threads int
+	Hold    time.Duration
+}
+
+// Stages expands the profile into the thread counts it goes through
+func (p *Profile) Stages() ([]Stage, error) {
+	if p.From < 1 || p.To < 1 {
+		return nil, fmt.Errorf("%s profile needs from and to of 1 thread or more", p.Kind)
+	}
+	d, err := time.ParseDuration(p.Duration)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("%s profile needs a duration, like 30s", p.Kind)
+	}
+	var hold time.Duration
+	if len(p.Hold) > 0 {
+		if hold, err = time.ParseDuration(p.Hold); err != nil {
+			return nil, fmt.Errorf("invalid hold of the %s profile: %w", p.Kind, err)
+		}
+	}
+
+	switch p.Kind {
+	case ProfileRamp:
+		threads := levels(p.From, p.To, max(p.Step, 1))
+		stages := make([]Stage, len(threads))
+		for i, n := range threads {
+			stages[i] = Stage{Threads: n, Hold: d / time.Duration(len(threads))}
+		}
+		stages[len(stages)-1].Hold += hold
+		return stages, nil
+	case ProfileStep:
+		if p.Step < 1 {
+			return nil, fmt.Errorf("step profile needs a step of 1 thread or more")
+		}
+		var stages []Stage
+		for _, n := range levels(p.From, p.To, p.Step) {
+			stages = append(stages, Stage{Threads: n, Hold: d})
+		}
+		return stages, nil
+	case ProfileSpike:
+		if hold <= 0 {
+			return nil, fmt.Errorf("spike profile needs a hold, how long the spike lasts")
+		}
+		return []Stage{{Threads: p.From, Hold: d}, {Threads: p.To, Hold: hold}, {Threads: p.From, Hold: d}}, nil
+	}
+	return nil, fmt.Errorf("unknown profile kind %s: ramp, step or spike", p.Kind)
+}
+
+// levels returns from, from±step, ... up to to, to included
+func levels(from int, to int, step int) []int {
+	if to < from {
+		step = -step
+	}
+	var threads []int
+	for n := from; (step > 0 && n < to) || (step < 0 && n > to); n += step {
+		threads = append(threads, n)
+	}
+	return append(threads, to)
+}
+
+// MaxThreads returns the most threads the group runs on
+func (g *Group) MaxThreads() int {
+	if g.Profile == nil {
+		return g.Threads
+	}
+	return max(g.Threads, g.Profile.From, g.Profile.To)
+}
@@ -0,0 +1,175 @@
+package workload
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The text format: an optional MAX_THREADS line first, then an ID line and a THREADS line start a group,
+// then one SQL per line
+//
+//	MAX_THREADS = 5
+//	ID = sql-query-1
+//	THREADS = 5
+//	SESSION = SET work_mem = '64MB'
+//	TIMEOUT = 2s
+//	ARGS = [7, "abc"]
+//	SELECT * FROM t WHERE a = $1 AND b = $2
+const (
+	// MAX_THREADS line, the first one, is the most threads a group of the file runs
+	MAX_THREADS string = "MAX_THREADS = "
+	ID          string = "ID = "
+	THREADS     string = "THREADS = "
+	// SESSION lines follow the THREADS line, each is a statement the connections of the ID run once connected
+	SESSION string = "SESSION = "
+	// TIMEOUT line, after the THREADS one, sets the timeout of the SQLs of the ID, like 2s
+	TIMEOUT string = "TIMEOUT = "
+	// ARGS line, ahead of a SQL, is the JSON array of its bind variable values
+	ARGS string = "ARGS = "
+)
+
+type textReader struct {
+	f       *os.File
+	scanner *bufio.Scanner
+	// the line read past the SESSION and TIMEOUT lines of a group, returned next
+	pending *string
+}
+
+func newTextReader(f *os.File) *textReader {
+	scanner := bufio.NewScanner(f)
+	const maxCapacity int = 4194304
+	scanner.Buffer(make([]byte, maxCapacity), maxCapacity)
+	return &textReader{f: f, scanner: scanner}
+}
+
+func (r *textReader) line() (string, bool) {
+	if r.pending != nil {
+		s := *r.pending
+		r.pending = nil
+		return s, true
+	}
+	if !r.scanner.Scan() {
+		return "", false
+	}
+	return r.scanner.Text(), true
+}
+
+func (r *textReader) eof() error {
+	if err := r.scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (r *textReader) Next() (Record, error) {
+	s, ok := r.line()
+	if ok && strings.HasPrefix(s, MAX_THREADS) {
+		s, ok = r.line()
+	}
+	if !ok {
+		return Record{}, r.eof()
+	}
+
+	if strings.HasPrefix(s, ID) {
+		g := &Group{}
+		if _, err := fmt.Sscanf(s, ID+"%s", &g.ID); err != nil {
+			return Record{}, err
+		}
+		if s, ok = r.line(); !ok {
+			return Record{}, fmt.Errorf("no THREADS line for id %s", g.ID)
+		}
+		if _, err := fmt.Sscanf(s, THREADS+"%d", &g.Threads); err != nil {
+			return Record{}, err
+		}
+		// the settings of the group, up to its first SQL
+		for {
+			if s, ok = r.line(); !ok {
+				break
+			}
+			if strings.HasPrefix(s, SESSION) {
+				g.SessionInit = append(g.SessionInit, strings.TrimPrefix(s, SESSION))
+				continue
+			}
+			if strings.HasPrefix(s, TIMEOUT) {
+				g.Timeout = strings.TrimPrefix(s, TIMEOUT)
+				continue
+			}
+			r.pending = &s
+			break
+		}
+		return Record{Group: g}, nil
+	}
+
+	st := &Statement{SQL: s}
+	if strings.HasPrefix(s, ARGS) {
+		args, err := ParseArgs(strings.TrimPrefix(s, ARGS))
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid args: %w", err)
+		}
+		if st.SQL, ok = r.line(); !ok {
+			return Record{}, fmt.Errorf("no SQL after the args %s", s)
+		}
+		st.Args = args
+	}
+	return Record{Statement: st}, nil
+}
+
+func (r *textReader) Close() error {
+	return r.f.Close()
+}
+
+// textWriter writes the text format, it has no place for the statement timeouts, weights and expected rows
+type textWriter struct {
+	f *os.File
+}
+
+func (w *textWriter) Header(maxThreads int) error {
+	if maxThreads <= 0 {
+		return nil
+	}
+	_, err := w.f.WriteString(MAX_THREADS + strconv.Itoa(maxThreads) + "\n")
+	return err
+}
+
+func (w *textWriter) Group(g Group) error {
+	if g.Retries != nil || g.Profile != nil {
+		return fmt.Errorf("group retries and load profiles need the .jsonl format: %s", g.ID)
+	}
+	lines := []string{ID + strings.Join(strings.Fields(g.ID), "+"), THREADS + strconv.Itoa(g.Threads)}
+	for _, init := range g.SessionInit {
+		lines = append(lines, SESSION+init)
+	}
+	if len(g.Timeout) > 0 {
+		lines = append(lines, TIMEOUT+g.Timeout)
+	}
+	_, err := w.f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+func (w *textWriter) Statement(s Statement) error {
+	if strings.ContainsAny(s.SQL, "\r\n") {
+		return fmt.Errorf("multi-line SQL needs the .jsonl format: %s", s.SQL)
+	}
+	if len(s.Timeout) > 0 || s.Weight > 0 || s.ExpectRows != nil || len(s.Transaction) > 0 {
+		return fmt.Errorf("SQL timeout, weight, expectRows and transactions need the .jsonl format: %s", s.SQL)
+	}
+	if len(s.Args) > 0 {
+		b, err := marshalArgs(s.Args)
+		if err != nil {
+			return err
+		}
+		if _, err := w.f.WriteString(ARGS + string(b) + "\n"); err != nil {
+			return err
+		}
+	}
+	_, err := w.f.WriteString(s.SQL + "\n")
+	return err
+}
+
+func (w *textWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,180 @@
+package workload
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Group is the header of a group of SQLs: they run on Threads threads with its settings
+type Group struct {
+	ID      string `json:"id"`
+	Threads int    `json:"threads"`
+	// statements each connection of the group runs once connected
+	SessionInit []string `json:"sessionInit,omitempty"`
+	// cancel the SQLs running longer, like 2s, instead of the --statement-timeout of the stress
+	Timeout string `json:"timeout,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// how many times the transactions aborted by a serialization failure or a deadlock are run again,
+	// instead of the --tx-retries of the stress
+	Retries *int `json:"retries,omitempty"`
+	// varies the threads over time instead of Threads, the stats are reported per stage
+	Profile *Profile `json:"profile,omitempty"`
+}
+
+// Statement is a SQL of the last group, or a transaction of the statements in Transaction
+type Statement struct {
+	SQL  string `json:"sql,omitempty"`
+	Args []any  `json:"args,omitempty"` // the bind variable values, the SQL runs as a prepared statement
+	// overrides the timeout of the group for this SQL
+	Timeout string `json:"timeout,omitempty"`
+	// how many times the SQL runs, once if 0
+	Weight int `json:"weight,omitempty"`
+	// the SQL runs as a query and returning another row count is an error
+	ExpectRows *int `json:"expectRows,omitempty"`
+	// the steps of a transaction run as one unit, their SQL, args and expectRows are used
+	Transaction []Statement `json:"transaction,omitempty"`
+}
+
+// Record is a group header or a statement, the one that is not nil
+type Record struct {
+	Group     *Group
+	Statement *Statement
+}
+
+type Reader interface {
+	// Next returns the next record, io.EOF after the last one
+	Next() (Record, error)
+	Close() error
+}
+
+type Writer interface {
+	// Header goes first: the most threads a group of the file runs, so the stress sizes its pool without reading it through
+	Header(maxThreads int) error
+	Group(g Group) error
+	Statement(s Statement) error
+	Close() error
+}
+
+// IsJSONL tells the format of the file by its extension: JSON Lines for .jsonl, the text format otherwise
+func IsJSONL(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".jsonl")
+}
+
+// Open opens the workload file for reading in the format of its extension
+func Open(path string) (Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsJSONL(path) {
+		return newJSONLReader(f), nil
+	}
+	return newTextReader(f), nil
+}
+
+// Create creates the workload file in the format of its extension
+func Create(path string) (Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsJSONL(path) {
+		enc := json.NewEncoder(f)
+		// keep the < and > of the SQLs readable
+		enc.SetEscapeHTML(false)
+		return &jsonlWriter{f: f, enc: enc}, nil
+	}
+	return &textWriter{f: f}, nil
+}
+
+// MaxThreads returns the most threads a group of the file runs, 0 if the file can't be read.
+// The files the seed writes tell it in their header, the others are read through.
+func MaxThreads(path string) int {
+	if n, ok := headerThreads(path); ok {
+		return n
+	}
+	r, err := Open(path)
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+
+	threads := 0
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			return threads
+		}
+		if rec.Group != nil {
+			threads = max(threads, rec.Group.MaxThreads())
+		}
+	}
+}
+
+// headerThreads reads the max threads of the header, the first line of the file, if it has one
+func headerThreads(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return 0, false
+	}
+	line = strings.TrimSpace(line)
+
+	if IsJSONL(path) {
+		var rec jsonlRecord
+		if json.Unmarshal([]byte(line), &rec) != nil || rec.MaxThreads == 0 || rec.Group != nil || rec.Statement != nil {
+			return 0, false
+		}
+		return rec.MaxThreads, true
+	}
+	var n int
+	if !strings.HasPrefix(line, MAX_THREADS) {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(line, MAX_THREADS+"%d", &n); err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// ParseArgs decodes a JSON array of bind variable values, the whole numbers as int64 for the drivers
+func ParseArgs(s string) ([]any, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	args := []any{}
+	if err := d.Decode(&args); err != nil {
+		return nil, err
+	}
+	if err := numbers(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// numbers turns the json.Numbers of the args into int64 or float64
+func numbers(args []any) error {
+	for i, a := range args {
+		n, ok := a.(json.Number)
+		if !ok {
+			continue
+		}
+		if v, err := n.Int64(); err == nil {
+			args[i] = v
+			continue
+		}
+		v, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("arg %d: %w", i+1, err)
+		}
+		args[i] = v
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package workload
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string) []Record {
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var recs []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func Test_roundTrip(t *testing.T) {
+	one := 1
+	tests := []struct {
+		name string
+		file string
+		recs []Record
+	}{
+		{"text", "workload.txt", []Record{
+			{Group: &Group{ID: "q1", Threads: 2, SessionInit: []string{"SET work_mem = '64MB'"}, Timeout: "2s"}},
+			{Statement: &Statement{SQL: "SELECT 1"}},
+			{Statement: &Statement{SQL: "SELECT * FROM t WHERE a = $1 AND b = $2", Args: []any{int64(7), "it's"}}},
+			{Group: &Group{ID: "q2", Threads: 1}},
+			{Statement: &Statement{SQL: "SELECT 2"}},
+		}},
+		{"jsonl", "workload.jsonl", []Record{
+			{Group: &Group{ID: "q1", Threads: 2, SessionInit: []string{"SET work_mem = '64MB'"}, Timeout: "2s", Comment: "blah"}},
+			{Statement: &Statement{SQL: "SELECT count(*)\nFROM t\nWHERE a < $1", Args: []any{int64(7), nil, 1.5}, Timeout: "1s", Weight: 3, ExpectRows: &one}},
+			{Group: &Group{ID: "q2", Threads: 1, Retries: &one}},
+			{Statement: &Statement{SQL: "SELECT 2"}},
+			{Statement: &Statement{Transaction: []Statement{
+				{SQL: "SELECT b FROM t WHERE a = $1 FOR UPDATE", Args: []any{int64(7)}, ExpectRows: &one},
+				{SQL: "UPDATE t SET b = 'x' WHERE a = 7"},
+			}}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			w, err := Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range tt.recs {
+				if rec.Group != nil {
+					err = w.Group(*rec.Group)
+				} else {
+					err = w.Statement(*rec.Statement)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := readAll(t, path)
+			if !reflect.DeepEqual(got, tt.recs) {
+				for i := range got {
+					t.Logf("%d: %+v %+v", i, got[i].Group, got[i].Statement)
+				}
+				t.Errorf("read %d records, want %v", len(got), tt.recs)
+			}
+			if n := MaxThreads(path); n != 2 {
+				t.Errorf("MaxThreads() = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func Test_textFormat(t *testing.T) {
+	// the layout of the files written before the JSON Lines format
+	path := filepath.Join(t.TempDir(), "sqls.txt")
+	if err := os.WriteFile(path, []byte("ID = a\nTHREADS = 3\nSELECT 1\nSELECT 2\nID = b\nTHREADS = 1\nID = c\nTHREADS = 1\nSELECT 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{
+		{Group: &Group{ID: "a", Threads: 3}},
+		{Statement: &Statement{SQL: "SELECT 1"}},
+		{Statement: &Statement{SQL: "SELECT 2"}},
+		{Group: &Group{ID: "b", Threads: 1}},
+		{Group: &Group{ID: "c", Threads: 1}},
+		{Statement: &Statement{SQL: "SELECT 3"}},
+	}
+	if got := readAll(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+
+	w, err := Create(filepath.Join(t.TempDir(), "multi.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Statement(Statement{SQL: "SELECT 1\nFROM t"}); err == nil {
+		t.Error("multi-line SQL written to the text format")
+	}
+}
+
+func Test_header(t *testing.T) {
+	for _, file := range []string{"workload.txt", "workload.jsonl"} {
+		t.Run(file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), file)
+			w, err := Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the header is trusted, the groups are not read for their threads
+			if err := w.Header(5); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Group(Group{ID: "q", Threads: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Statement(Statement{SQL: "SELECT 1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := MaxThreads(path); n != 5 {
+				t.Errorf("MaxThreads() = %d, want the 5 of the header", n)
+			}
+			want := []Record{{Group: &Group{ID: "q", Threads: 2}}, {Statement: &Statement{SQL: "SELECT 1"}}}
+			if got := readAll(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("read %v, want %v", got, want)
+			}
+
+			// no threads, no header: the file reads as one without it
+			path = filepath.Join(t.TempDir(), file)
+			if w, err = Create(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Header(0); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Group(Group{ID: "q", Threads: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Statement(Statement{SQL: "SELECT 1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("read %v of a file with no threads in the header, want %v", got, want)
+			}
+			if n := MaxThreads(path); n != 2 {
+				t.Errorf("MaxThreads() = %d without a header, want the 2 of the group", n)
+			}
+		})
+	}
+}
+
+func Test_ParseArgs(t *testing.T) {
+	args, err := ParseArgs(`[7, "it's", null, 1.5]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{int64(7), "it's", nil, 1.5}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("ParseArgs() = %#v, want %#v", args, want)
+	}
+	if _, err := ParseArgs(`7`); err == nil {
+		t.Error("ParseArgs() of a number is no error")
+	}
+}
+
+func Test_Stages(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Profile
+		want    []Stage
+		wantErr bool
+	}{
+		{"ramp", Profile{Kind: ProfileRamp, From: 1, To: 4, Step: 2, Duration: "3s", Hold: "10s"},
+			[]Stage{{1, time.Second}, {3, time.Second}, {4, 11 * time.Second}}, false},
+		{"ramp down", Profile{Kind: ProfileRamp, From: 3, To: 1, Duration: "3s"},
+			[]Stage{{3, time.Second}, {2, time.Second}, {1, time.Second}}, false},
+		{"step", Profile{Kind: ProfileStep, From: 2, To: 6, Step: 2, Duration: "1m"},
+			[]Stage{{2, time.Minute}, {4, time.Minute}, {6, time.Minute}}, false},
+		{"spike", Profile{Kind: ProfileSpike, From: 2, To: 20, Duration: "1m", Hold: "5s"},
+			[]Stage{{2, time.Minute}, {20, 5 * time.Second}, {2, time.Minute}}, false},
+		{"step without step", Profile{Kind: ProfileStep, From: 2, To: 6, Duration: "1m"}, nil, true},
+		{"spike without hold", Profile{Kind: ProfileSpike, From: 2, To: 6, Duration: "1m"}, nil, true},
+		{"no duration", Profile{Kind: ProfileRamp, From: 2, To: 6}, nil, true},
+		{"no threads", Profile{Kind: ProfileRamp, To: 6, Duration: "1m"}, nil, true},
+		{"unknown kind", Profile{Kind: "wave", From: 2, To: 6, Duration: "1m"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.Stages()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"github.com/yurizf/rdb-seeder-stress-tester/cmd"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if err := cmd.App().Run(os.Args); err != nil {
+	// Ctrl-C or SIGTERM cancels the context: the commands stop taking new work and write the stats they have.
+	// A second signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := cmd.App().RunContext(ctx, os.Args); err != nil {
 		log.Printf("[ERROR] command exited with error %s", err)
 	}
 }